@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,6 +15,7 @@ import (
 	"github.com/risingwavelabs/promdump/pkg/promdump"
 	"github.com/risingwavelabs/promdump/utils"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
@@ -26,6 +31,11 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:   "versions",
+				Usage:  "List the RisingWave versions whose dashboard is cached, or embedded in the binary",
+				Action: runVersions,
+			},
 			{
 				Name:   "dump",
 				Usage:  "Dump Prometheus metrics to static files",
@@ -37,11 +47,22 @@ func main() {
 						Usage:   "Output directory",
 						Value:   ".",
 					},
+					&cli.StringSliceFlag{
+						Name:    "endpoint",
+						Aliases: []string{"e"},
+						Usage:   "Prometheus endpoint URL, required unless --grafana-url is set. Can be specified multiple times to query all endpoints, e.g. HA pairs or sharded instances, the series with the same labels are merged",
+					},
+					&cli.StringFlag{
+						Name:  "source-label",
+						Usage: "Set this label to the endpoint of every series, e.g. promdump_source. A series returned by several endpoints gets the first one of --endpoint that returned it in the time chunk",
+					},
+					&cli.StringFlag{
+						Name:  "grafana-url",
+						Usage: "Grafana URL, e.g. https://grafana.example.com. If set, Prometheus is queried through the datasource proxy of Grafana instead of --endpoint, with the datasource --datasource-uid and the token --grafana-token",
+					},
 					&cli.StringFlag{
-						Name:     "endpoint",
-						Aliases:  []string{"e"},
-						Usage:    "Prometheus endpoint URL",
-						Required: true,
+						Name:  "datasource-uid",
+						Usage: "UID of the Prometheus datasource in Grafana, used with --grafana-url",
 					},
 					&cli.StringFlag{
 						Name:  "start",
@@ -66,10 +87,42 @@ func main() {
 						Value: "",
 					},
 					&cli.StringFlag{
-						Name:  "grafana-dashboard",
-						Usage: "Retrieve metrics names from risingwave official grafana dashboard. If this is set, no need to use --query. This can be the path to a grafana dashboard file, or just the version of RisingWave. If the version is provided, promdump will read the grafana dashboard in the Github repository",
+						Name: "selector",
+						Usage: "Series selector whose matchers are added to the query of every metric, e.g. {namespace=\"rw\",risingwave_cluster=\"prod\"}. " +
+							"Use it with --grafana-dashboard to only dump the series of a cluster. It can't be used with --query.",
 						Value: "",
 					},
+					&cli.StringSliceFlag{
+						Name:  "grafana-dashboard",
+						Usage: "Retrieve metrics names from risingwave official grafana dashboard. If this is set, no need to use --query. This can be the path to a grafana dashboard file, just the version of RisingWave, or grafana://host/uid/<uid> or grafana://host/search?tag=<tag> to read dashboards from a Grafana instance. If the version is provided, promdump will read the grafana dashboard in the Github repository. Can be specified multiple times, the metrics of all dashboards are dumped. Use auto to detect the version of RisingWave from the endpoint, the detected version is recorded in promdump-metadata.json in the output directory",
+					},
+					&cli.StringFlag{
+						Name:    "grafana-token",
+						Usage:   "Grafana API or service account token used to read dashboards from grafana:// URLs, and to query through --grafana-url",
+						EnvVars: []string{"GRAFANA_TOKEN"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "rules-file",
+						Usage: "Retrieve metrics names from the expressions of a Prometheus rule file or a PrometheusRule resource. Can be specified multiple times, and combined with --grafana-dashboard",
+					},
+					&cli.BoolFlag{
+						Name:  "recorded-series",
+						Usage: "Also include the series written by the recording rules of --rules-file",
+						Value: false,
+					},
+					&cli.StringSliceFlag{
+						Name:  "dashboard-row",
+						Usage: "Only use the panels in the rows of the grafana dashboard matching this id or title regex, e.g. --dashboard-row 'Streaming.*'. Can be specified multiple times",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dashboard-panel",
+						Usage: "Only use the panels of the grafana dashboard matching this id or title regex. Can be specified multiple times",
+					},
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Fail if any query of the grafana dashboard can't be parsed, instead of skipping it with a warning",
+						Value: false,
+					},
 					&cli.BoolFlag{
 						Name:  "gzip",
 						Usage: "Output in compressed NDJSON format",
@@ -85,6 +138,55 @@ func main() {
 						Usage: "(0, 1], if OOM, reduce the memory usage in Prometheus instance by this ratio",
 						Value: 1,
 					},
+					&cli.IntFlag{
+						Name:  "batch-max-series",
+						Usage: "Query several metrics at once with {__name__=~\"a|b|c\"}, with at most this number of series per query, estimated with the series API. Reduces the number of requests for dashboards with many small metrics. 0 queries every metric alone",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "tenant",
+						Usage: "Send the tenant as the X-Scope-OrgID header of every request, for Mimir, Cortex or Thanos",
+					},
+					&cli.BoolFlag{
+						Name:  "dedup",
+						Usage: "Set the dedup parameter of Thanos, to deduplicate the series of replicas. Not sent if unset",
+					},
+					&cli.BoolFlag{
+						Name:  "partial-response",
+						Usage: "Set the partial_response parameter of Thanos, to allow results when some stores are unavailable. Not sent if unset",
+					},
+					&cli.StringFlag{
+						Name:  "max-source-resolution",
+						Usage: "Set the max_source_resolution parameter of Thanos to query downsampled data, e.g. 5m, 1h or auto",
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "Where the samples come from: query-range queries them at every step, vm-export streams the raw samples from the /api/v1/export API of VictoriaMetrics, auto uses the export API of the backend if any",
+						Value: promdump.SourceQueryRange,
+					},
+					&cli.StringFlag{
+						Name:  "backend",
+						Usage: "The backend of the endpoint: auto, prometheus, thanos, mimir, victoriametrics or gmp. auto probes the endpoint, and assumes prometheus if the probes fail. It selects the max points per series, whether selectors without a metric name are allowed, and the export API",
+						Value: "auto",
+					},
+					&cli.IntFlag{
+						Name:  "max-points",
+						Usage: "Override the max points per series of a range query of the backend. 0 uses the one of the backend",
+						Value: 0,
+					},
+					&cli.BoolFlag{
+						Name:  "arbitrary-selectors",
+						Usage: "Override whether the backend allows selectors without a metric name, e.g. with --query or --batch-max-series",
+					},
+					&cli.IntFlag{
+						Name:  "shard-max-series",
+						Usage: "Split the query of a metric with more series than this into one query per value of --shard-label. Queries rejected by the endpoint as too large are always split. 0 only splits rejected queries",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "shard-label",
+						Usage: "The label to split large queries by, e.g. instance. Defaults to the label of the query with the most values",
+					},
 					&cli.IntFlag{
 						Name:    "parts",
 						Aliases: []string{"p"},
@@ -98,10 +200,84 @@ func main() {
 				Usage:  "List all metrics names in RisingWave",
 				Action: runListMetrics,
 				Flags: []cli.Flag{
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:  "grafana-dashboard",
-						Usage: "Retrieve metrics names from risingwave official grafana dashboard. This can be the path to a grafana dashboard file, or just the version of RisingWave. If the version is provided, promdump will read the grafana dashboard in the Github repository",
-						Value: "",
+						Usage: "Retrieve metrics names from risingwave official grafana dashboard. This can be the path to a grafana dashboard file, just the version of RisingWave, or grafana://host/uid/<uid> or grafana://host/search?tag=<tag> to read dashboards from a Grafana instance. If the version is provided, promdump will read the grafana dashboard in the Github repository. Can be specified multiple times",
+					},
+					&cli.StringFlag{
+						Name:    "grafana-token",
+						Usage:   "Grafana API or service account token used to read dashboards from grafana:// URLs, and to query through --grafana-url",
+						EnvVars: []string{"GRAFANA_TOKEN"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "rules-file",
+						Usage: "Retrieve metrics names from the expressions of a Prometheus rule file or a PrometheusRule resource. Can be specified multiple times, and combined with --grafana-dashboard",
+					},
+					&cli.BoolFlag{
+						Name:  "recorded-series",
+						Usage: "Also include the series written by the recording rules of --rules-file",
+						Value: false,
+					},
+					&cli.StringSliceFlag{
+						Name:  "dashboard-row",
+						Usage: "Only use the panels in the rows of the grafana dashboard matching this id or title regex, e.g. --dashboard-row 'Streaming.*'. Can be specified multiple times",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dashboard-panel",
+						Usage: "Only use the panels of the grafana dashboard matching this id or title regex. Can be specified multiple times",
+					},
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Fail if any query of the grafana dashboard can't be parsed, instead of skipping it with a warning",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "report",
+						Usage: "Print the queries that can't be parsed, with their panel id and title, to stderr",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: text (metric names only), json, yaml or table. json, yaml and table list the dashboards, rows, panels and expressions using each metric",
+						Value: "text",
+					},
+					&cli.BoolFlag{
+						Name:  "diff",
+						Usage: "Compare two dashboards given as arguments, e.g. --diff v2.5.0 v2.6.2, and report the added and removed metrics and the panels whose expressions changed",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "check",
+						Usage: "Compare the metrics with the metrics of --endpoint between --start and --end, and report present metrics with their series counts, missing and extra metrics",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:    "endpoint",
+						Aliases: []string{"e"},
+						Usage:   "Prometheus endpoint URL, used with --check",
+					},
+					&cli.StringFlag{
+						Name:  "selector",
+						Usage: "Series selector like {namespace=\"rw\"}, used with --check to only check the series of a cluster",
+					},
+					&cli.StringFlag{
+						Name:  "tenant",
+						Usage: "Send the tenant as the X-Scope-OrgID header of every request, used with --check",
+					},
+					&cli.StringFlag{
+						Name:  "start",
+						Usage: "Start time (RFC3339 format), used with --check",
+						Value: time.Now().Add(-7 * 24 * time.Hour).Format(time.RFC3339),
+					},
+					&cli.StringFlag{
+						Name:  "end",
+						Usage: "End time (RFC3339 format), used with --check",
+						Value: time.Now().Format(time.RFC3339),
+					},
+					&cli.Float64Flag{
+						Name:  "max-missing-ratio",
+						Usage: "[0, 1], with --check, exit with an error if the ratio of missing metrics is above this value",
+						Value: 1,
 					},
 				},
 			},
@@ -119,29 +295,23 @@ func main() {
 
 // runDump implements the 'dump' command to dump Prometheus data to a file
 func runDump(c *cli.Context) error {
-	endpoint := c.String("endpoint")
-	if endpoint == "" {
+	endpoints := c.StringSlice("endpoint")
+	var endpoint string
+	if len(endpoints) > 0 {
+		endpoint = endpoints[0]
+	}
+	grafanaURL := c.String("grafana-url")
+	if endpoint == "" && grafanaURL == "" {
 		return fmt.Errorf("prometheus endpoint is required")
 	}
+	if grafanaURL != "" && c.String("datasource-uid") == "" {
+		return fmt.Errorf("--datasource-uid is required with --grafana-url")
+	}
 
 	startStr := c.String("start")
 	endStr := c.String("end")
 	step := c.Duration("step")
 	parts := c.Int("parts")
-	dashboard := c.String("grafana-dashboard")
-
-	var (
-		metricsNames []string
-		err          error
-	)
-	if dashboard != "" {
-		parser := promdump.NewGrafanaDashboardParser()
-		metricsNames, err = parser.Parse(dashboard)
-		if err != nil {
-			return errors.Wrap(err, "failed to parse grafana dashboard")
-		}
-		fmt.Printf("Retrieved %d metrics names from grafana dashboard\n", len(metricsNames))
-	}
 
 	if parts < 1 {
 		return fmt.Errorf("parts must be greater than 0")
@@ -170,22 +340,89 @@ func runDump(c *cli.Context) error {
 		return errors.Wrap(err, "failed to parse end time")
 	}
 
+	opt := &promdump.DumpOpt{
+		Endpoint:       endpoint,
+		Start:          start,
+		End:            end,
+		Step:           step,
+		Query:          c.String("query"),
+		Selector:       c.String("selector"),
+		BatchMaxSeries: c.Int("batch-max-series"),
+		ShardMaxSeries: c.Int("shard-max-series"),
+		ShardLabel:     c.String("shard-label"),
+		Gzip:           c.Bool("gzip"),
+		MemoryRatio:    memoryRatio,
+		GrafanaURL:     grafanaURL,
+		DatasourceUID:  c.String("datasource-uid"),
+		GrafanaToken:   c.String("grafana-token"),
+		Source:         c.String("source"),
+		Tenant:         c.String("tenant"),
+		SourceLabel:    c.String("source-label"),
+
+		MaxSourceResolution: c.String("max-source-resolution"),
+	}
+	if len(endpoints) > 1 {
+		opt.Endpoints = endpoints
+	}
+	if c.IsSet("dedup") {
+		dedup := c.Bool("dedup")
+		opt.Dedup = &dedup
+	}
+	if c.IsSet("partial-response") {
+		partialResponse := c.Bool("partial-response")
+		opt.PartialResponse = &partialResponse
+	}
+
+	if opt.Capabilities, err = backendCapabilities(c, opt); err != nil {
+		return err
+	}
+	if opt.Source == "auto" {
+		opt.Source = promdump.SourceQueryRange
+		if opt.Capabilities.Export != "" {
+			opt.Source = opt.Capabilities.Export
+		}
+		fmt.Printf("Using source %s\n", opt.Source)
+	}
+
+	var metadata *promdump.Metadata
+	dashboards := c.StringSlice("grafana-dashboard")
+	if len(dashboards) > 0 || len(c.StringSlice("rules-file")) > 0 {
+		metadata = &promdump.Metadata{}
+		for i, dashboard := range dashboards {
+			if dashboard != "auto" {
+				continue
+			}
+			if metadata.RisingWaveVersion == "" {
+				version, err := promdump.DetectRisingWaveVersion(c.Context, opt)
+				if err != nil {
+					return errors.Wrap(err, "failed to detect RisingWave version, please specify the version with --grafana-dashboard")
+				}
+				fmt.Printf("Detected RisingWave version %s\n", version)
+				metadata.RisingWaveVersion = version
+			}
+			dashboards[i] = metadata.RisingWaveVersion
+		}
+		metadata.Dashboards = dashboards
+
+		result, err := parseMetricsSources(c, dashboards)
+		if err != nil {
+			return err
+		}
+		opt.MetricsNames, opt.MetricsPatterns = result.Metrics, result.Patterns
+		if len(result.Failures) > 0 {
+			fmt.Printf("Warning: skipped %d queries that can't be parsed, use `promdump list-metrics --report` to list them\n", len(result.Failures))
+		}
+		fmt.Printf("Retrieved %d metrics names and %d metrics patterns from grafana dashboards and rules\n", len(opt.MetricsNames), len(opt.MetricsPatterns))
+	}
+
 	return promdump.DumpMultipart(
 		c.Context,
 		&promdump.DumpMultipartCfg{
-			Opt: &promdump.DumpOpt{
-				Endpoint:     endpoint,
-				Start:        start,
-				End:          end,
-				Step:         step,
-				Query:        c.String("query"),
-				MetricsNames: metricsNames,
-				Gzip:         c.Bool("gzip"),
-				MemoryRatio:  memoryRatio,
-			},
+			Opt:       opt,
 			Parts:     parts,
 			OutputDir: c.String("out"),
 			Verbose:   true,
+			Metadata:  metadata,
 		},
 		func(curr, total int, progress float32) error {
 			fmt.Printf("\033[2K\r[%d/%d] progress: %s", curr, total, utils.RenderProgressBar(progress))
@@ -194,20 +431,290 @@ func runDump(c *cli.Context) error {
 	)
 }
 
+// backendCapabilities returns the capabilities of the backend of --backend, or
+// of the detected one, with the overrides of the flags. If the backend can't
+// be detected, e.g. as the probes are not allowed, it is assumed to be
+// Prometheus.
+func backendCapabilities(c *cli.Context, opt *promdump.DumpOpt) (*promdump.Capabilities, error) {
+	var (
+		capabilities *promdump.Capabilities
+		err          error
+	)
+	if backend := c.String("backend"); backend == "auto" {
+		if capabilities, err = promdump.DetectBackend(c.Context, opt); err != nil {
+			fmt.Printf("Warning: failed to detect the backend, assuming %s, specify it with --backend otherwise: %v\n", promdump.BackendPrometheus, err)
+			if capabilities, err = promdump.BackendCapabilities(promdump.BackendPrometheus); err != nil {
+				return nil, err
+			}
+		}
+	} else if capabilities, err = promdump.BackendCapabilities(backend); err != nil {
+		return nil, err
+	}
+	if maxPoints := c.Int("max-points"); maxPoints != 0 {
+		capabilities.MaxPoints = maxPoints
+	}
+	if c.IsSet("arbitrary-selectors") {
+		capabilities.ArbitrarySelectors = c.Bool("arbitrary-selectors")
+	}
+	fmt.Printf("Using %s\n", capabilities)
+	return capabilities, nil
+}
+
 func runListMetrics(c *cli.Context) error {
-	dashboard := c.String("grafana-dashboard")
-	if dashboard == "" {
-		return errors.New("dashboard is required. It can be the path to a grafana dashboard file, or just the version of RisingWave.")
+	if c.Bool("diff") {
+		return runDiff(c)
+	}
+	if len(c.StringSlice("grafana-dashboard")) == 0 && len(c.StringSlice("rules-file")) == 0 {
+		return errors.New("dashboard or rules file is required. The dashboard can be the path to a grafana dashboard file, or just the version of RisingWave.")
 	}
 
-	parser := promdump.NewGrafanaDashboardParser()
-	metrics, err := parser.Parse(dashboard)
+	result, err := parseMetricsSources(c, c.StringSlice("grafana-dashboard"))
 	if err != nil {
-		return errors.Wrap(err, "failed to parse grafana dashboard")
+		return err
 	}
 
-	for _, metricName := range metrics {
-		fmt.Println(metricName)
+	if c.Bool("check") {
+		if err := checkCoverage(c, result); err != nil {
+			return err
+		}
+	} else if err := printLineage(os.Stdout, c.String("format"), result); err != nil {
+		return err
+	}
+	// patterns and failures are printed to stderr, so that the output can still be used as a list of names
+	for _, pattern := range result.Patterns {
+		fmt.Fprintf(os.Stderr, "metrics matching %q are also needed, they can only be resolved against an endpoint\n", pattern)
+	}
+	if c.Bool("report") {
+		for _, f := range result.Failures {
+			fmt.Fprintf(os.Stderr, "failed to parse %s\n", f.String())
+		}
+	} else if len(result.Failures) > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d queries that can't be parsed, use --report to list them\n", len(result.Failures))
+	}
+	return nil
+}
+
+func runVersions(c *cli.Context) error {
+	versions, err := promdump.Versions()
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		fmt.Fprintln(os.Stderr, "no RisingWave version is cached or embedded, dashboards fetched from Github with --grafana-dashboard <version> are cached")
+		return nil
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "-"
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tDASHBOARD\tMETRICS\tCACHED")
+	for _, v := range versions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Version, yesNo(v.Dashboard), yesNo(v.Metrics), yesNo(v.Cached))
+	}
+	return tw.Flush()
+}
+
+// runDiff compares the metrics of the two dashboards given as arguments.
+func runDiff(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return errors.New("--diff requires two dashboards, e.g. --diff v2.5.0 v2.6.2")
+	}
+	from, err := parseMetricsSources(c, []string{c.Args().Get(0)})
+	if err != nil {
+		return err
+	}
+	to, err := parseMetricsSources(c, []string{c.Args().Get(1)})
+	if err != nil {
+		return err
+	}
+	diff := promdump.DiffMetrics(from, to)
+
+	switch format := c.String("format"); format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			return errors.Wrap(err, "failed to encode diff")
+		}
+	case "yaml":
+		if err := yaml.NewEncoder(os.Stdout).Encode(diff); err != nil {
+			return errors.Wrap(err, "failed to encode diff")
+		}
+	case "text", "table":
+		for _, metric := range diff.Added {
+			fmt.Printf("+ %s\n", metric)
+		}
+		for _, metric := range diff.Removed {
+			fmt.Printf("- %s\n", metric)
+		}
+		for _, panel := range diff.AddedPanels {
+			fmt.Printf("+ %s\n", panel)
+		}
+		for _, panel := range diff.RemovedPanels {
+			fmt.Printf("- %s\n", panel)
+		}
+		for _, q := range diff.Changed {
+			fmt.Printf("~ %s\n", q.Location)
+			for _, expr := range q.Old {
+				fmt.Printf("    - %s\n", strings.Join(strings.Fields(expr), " "))
+			}
+			for _, expr := range q.New {
+				fmt.Printf("    + %s\n", strings.Join(strings.Fields(expr), " "))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q, must be one of text, json, yaml, table", format)
+	}
+	fmt.Fprintf(os.Stderr, "%d added, %d removed metrics, %d added, %d removed panels, %d changed queries\n", len(diff.Added), len(diff.Removed), len(diff.AddedPanels), len(diff.RemovedPanels), len(diff.Changed))
+	return nil
+}
+
+// checkCoverage reports the metrics of the result present in or missing from
+// the endpoint, and the extra metrics of the endpoint.
+func checkCoverage(c *cli.Context, result *promdump.ParseResult) error {
+	if c.String("endpoint") == "" {
+		return errors.New("--endpoint is required with --check")
+	}
+	start, err := time.Parse(time.RFC3339, c.String("start"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse start time")
+	}
+	end, err := time.Parse(time.RFC3339, c.String("end"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse end time")
+	}
+	coverage, err := promdump.CheckCoverage(c.Context, &promdump.DumpOpt{
+		Endpoint: c.String("endpoint"),
+		Start:    start,
+		End:      end,
+		Selector: c.String("selector"),
+		Tenant:   c.String("tenant"),
+	}, result.Metrics, result.Patterns)
+	if err != nil {
+		return errors.Wrap(err, "failed to check metrics coverage")
+	}
+
+	switch format := c.String("format"); format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(coverage); err != nil {
+			return errors.Wrap(err, "failed to encode coverage")
+		}
+	case "yaml":
+		if err := yaml.NewEncoder(os.Stdout).Encode(coverage); err != nil {
+			return errors.Wrap(err, "failed to encode coverage")
+		}
+	case "text", "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATUS\tMETRIC\tSERIES")
+		for _, m := range coverage.Present {
+			fmt.Fprintf(tw, "present\t%s\t%d\n", m.Metric, m.Series)
+		}
+		for _, m := range coverage.PatternMatched {
+			fmt.Fprintf(tw, "matched\t%s\t%d\n", m.Metric, m.Series)
+		}
+		for _, m := range coverage.Missing {
+			fmt.Fprintf(tw, "missing\t%s\t0\n", m)
+		}
+		for _, m := range coverage.Extra {
+			fmt.Fprintf(tw, "extra\t%s\t%d\n", m.Metric, m.Series)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q, must be one of text, json, yaml, table", format)
+	}
+
+	ratio := coverage.MissingRatio()
+	fmt.Fprintf(os.Stderr, "%d present, %d matched by patterns, %d missing (%.1f%%), %d extra metrics\n", len(coverage.Present), len(coverage.PatternMatched), len(coverage.Missing), ratio*100, len(coverage.Extra))
+	if maxRatio := c.Float64("max-missing-ratio"); ratio > maxRatio {
+		return fmt.Errorf("the ratio of missing metrics %.3f is above --max-missing-ratio %.3f", ratio, maxRatio)
+	}
+	return nil
+}
+
+// parseMetricsSources parses the dashboards and rules files with the parser
+// options of the command, the result holds the metrics of all of them.
+func parseMetricsSources(c *cli.Context, dashboards []string) (*promdump.ParseResult, error) {
+	parser := promdump.NewGrafanaDashboardParser()
+	parser.Strict = c.Bool("strict")
+	parser.GrafanaToken = c.String("grafana-token")
+	parser.RecordedSeries = c.Bool("recorded-series")
+	for _, s := range c.StringSlice("dashboard-row") {
+		f, err := promdump.NewPanelFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		parser.RowFilters = append(parser.RowFilters, f)
+	}
+	for _, s := range c.StringSlice("dashboard-panel") {
+		f, err := promdump.NewPanelFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		parser.PanelFilters = append(parser.PanelFilters, f)
+	}
+
+	var result *promdump.ParseResult
+	for _, dashboard := range dashboards {
+		var err error
+		result, err = parser.Parse(dashboard)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse grafana dashboard %s", dashboard)
+		}
+	}
+	for _, file := range c.StringSlice("rules-file") {
+		var err error
+		result, err = parser.ParseRules(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse rules")
+		}
+	}
+	// an empty selection would dump everything
+	if len(dashboards) > 0 && len(result.Panels) == 0 && (len(parser.RowFilters) > 0 || len(parser.PanelFilters) > 0) {
+		return nil, errors.New("no panel of the grafana dashboard matches --dashboard-row and --dashboard-panel")
+	}
+	return result, nil
+}
+
+// printLineage prints the metrics of the dashboards and rules in the given format.
+func printLineage(w io.Writer, format string, result *promdump.ParseResult) error {
+	switch format {
+	case "text":
+		for _, metricName := range result.Metrics {
+			fmt.Fprintln(w, metricName)
+		}
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result.Lineage); err != nil {
+			return errors.Wrap(err, "failed to encode lineage")
+		}
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(result.Lineage); err != nil {
+			return errors.Wrap(err, "failed to encode lineage")
+		}
+		return enc.Close()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "METRIC\tDASHBOARD/FILE\tROW/GROUP\tLOCATION\tEXPR")
+		for _, lineage := range result.Lineage {
+			for _, u := range lineage.Usages {
+				// keep one line per usage
+				expr := strings.Join(strings.Fields(u.Expr), " ")
+				fmt.Fprintf(tw, "%s\t%s%s\t%s%s\t%s\t%s\n", lineage.Metric, u.Dashboard, u.File, u.Row, u.Group, u.Location(), expr)
+			}
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %q, must be one of text, json, yaml, table", format)
 	}
 	return nil
 }
@@ -8,15 +8,25 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/risingwavelabs/promdump/pkg/promdump"
 	"github.com/risingwavelabs/promdump/pkg/prompush"
 	"github.com/risingwavelabs/promdump/utils"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	app := &cli.App{
+	if err := newApp().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp returns the prompush command line app.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:   "prompush",
 		Usage:  "Push Prometheus data to a remote endpoint",
 		Action: runPush,
@@ -32,6 +42,23 @@ func main() {
 				Aliases: []string{"e"},
 				Usage:   "VictoriaMetrics endpoint URL",
 			},
+			&cli.StringFlag{
+				Name:  "remote-write-url",
+				Usage: "Push data with the Prometheus remote write protocol to this URL instead, e.g. http://localhost:9090/api/v1/write. Native histograms are supported",
+			},
+			&cli.StringFlag{
+				Name:  "tenant",
+				Usage: "Tenant of the pushes. With --remote-write-url, it is sent as the X-Scope-OrgID header, e.g. for Mimir or Cortex. With --vm-endpoint, it is the <accountID>[:<projectID>] tenant of a VictoriaMetrics cluster and --vm-endpoint is the vminsert URL, e.g. http://vminsert:8480",
+			},
+			&cli.StringFlag{
+				Name:  "tsdb-dir",
+				Usage: "Write data as Prometheus TSDB blocks to this directory instead. Native histograms are supported",
+			},
+			&cli.IntFlag{
+				Name:  "tsdb-max-samples",
+				Usage: "Maximum number of samples the TSDB writer keeps in memory before writing the oldest blocks",
+				Value: prompush.DefaultTSDBMaxSamples,
+			},
 			&cli.IntFlag{
 				Name:     "batch-size",
 				Aliases:  []string{"b"},
@@ -55,12 +82,42 @@ func main() {
 				Usage: "Ignore invalid files and continue processing other files when a directory is provided as input",
 				Value: false,
 			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Resume from the checkpoint of a previous run, skipping completed files and already imported lines",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "The path of the checkpoint file, default is <path>.prompush-checkpoint.json",
+			},
+			&cli.StringFlag{
+				Name:  "shift-to",
+				Usage: "Shift all timestamps so that the last sample lands at this time, `now` or RFC3339 format",
+			},
+			&cli.DurationFlag{
+				Name:  "shift-by",
+				Usage: "Shift all timestamps by this duration, e.g. 720h",
+			},
+			&cli.StringFlag{
+				Name:  "shift-label",
+				Usage: "Record the time shift in a label with this name, so that multiple replays of the same data don't collide",
+			},
+			&cli.StringSliceFlag{
+				Name:  "extra-label",
+				Usage: "Add a label to every series in the format name=value, overriding the existing label with the same name. Can be specified multiple times",
+			},
+			&cli.StringFlag{
+				Name:  "non-finite",
+				Usage: "What to do with NaN and ±Inf samples: `drop` only drops those samples, `keep` imports them as is",
+				Value: string(prompush.NonFiniteDrop),
+			},
+			&cli.StringFlag{
+				Name:  "label-prefix",
+				Usage: "Prepend this prefix to the names of all existing labels except __name__",
+			},
 		},
 	}
-
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
-	}
 }
 
 type LegacyFormat struct {
@@ -76,21 +133,70 @@ type Item struct {
 
 func runPush(c *cli.Context) error {
 	vmEndpoint := c.String("vm-endpoint")
+	remoteWriteURL := c.String("remote-write-url")
+	tsdbDir := c.String("tsdb-dir")
 	path := c.String("path")
 	batchSize := c.Int("batch-size")
 	noop := c.Bool("noop")
 	amp := c.Bool("amp")
 	ignoreInvalidFiles := c.Bool("ignore-invalid-files")
+	resume := c.Bool("resume")
+	checkpointPath := c.String("checkpoint")
+	shiftTo := c.String("shift-to")
+	shiftBy := c.Duration("shift-by")
 
 	if batchSize <= 0 {
 		return fmt.Errorf("batch-size must be greater than 0")
 	}
-	if len(vmEndpoint) == 0 && !noop {
-		return fmt.Errorf("vm-endpoint is required")
+	var target prompush.Target
+	targets := 0
+	if len(vmEndpoint) > 0 {
+		vmTarget := &prompush.VMImportTarget{Endpoint: vmEndpoint, Tenant: c.String("tenant")}
+		if _, err := vmTarget.ImportURL(); err != nil {
+			return err
+		}
+		target = vmTarget
+		targets++
+	}
+	if len(remoteWriteURL) > 0 {
+		target = &prompush.RemoteWriteTarget{URL: remoteWriteURL, Tenant: c.String("tenant")}
+		targets++
+	}
+	if len(tsdbDir) > 0 {
+		target = &prompush.TSDBTarget{Dir: tsdbDir, MaxSamples: c.Int("tsdb-max-samples")}
+		targets++
+	}
+	if noop {
+		target = &prompush.NoopTarget{}
+	} else if targets == 0 {
+		return fmt.Errorf("one of vm-endpoint, remote-write-url or tsdb-dir is required")
+	} else if targets > 1 {
+		return fmt.Errorf("only one of vm-endpoint, remote-write-url or tsdb-dir can be used")
 	}
 	if len(path) == 0 {
 		return fmt.Errorf("path is required")
 	}
+	if resume && noop {
+		return fmt.Errorf("resume cannot be used with noop")
+	}
+	if len(shiftTo) > 0 && shiftBy != 0 {
+		return fmt.Errorf("shift-to and shift-by cannot be used together")
+	}
+	extraLabels, err := parseExtraLabels(c.StringSlice("extra-label"))
+	if err != nil {
+		return err
+	}
+	nonFinite := prompush.NonFinitePolicy(c.String("non-finite"))
+	if nonFinite != prompush.NonFiniteDrop && nonFinite != prompush.NonFiniteKeep {
+		return fmt.Errorf("non-finite must be one of %s, %s", prompush.NonFiniteDrop, prompush.NonFiniteKeep)
+	}
+	labelPrefix := c.String("label-prefix")
+	if len(labelPrefix) > 0 && !model.LabelName(labelPrefix).IsValidLegacy() {
+		return fmt.Errorf("invalid label prefix: %s", labelPrefix)
+	}
+	if len(checkpointPath) == 0 {
+		checkpointPath = filepath.Clean(path) + ".prompush-checkpoint.json"
+	}
 
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -103,17 +209,39 @@ func runPush(c *cli.Context) error {
 			return fmt.Errorf("failed to read directory: %w", err)
 		}
 		for _, entry := range entries {
-			if entry.IsDir() {
+			// the metadata of promdump is not a data file
+			if entry.IsDir() || entry.Name() == promdump.MetadataFileName {
 				continue
 			}
 			files = append(files, filepath.Join(path, entry.Name()))
 		}
+		metadata, err := promdump.ReadMetadata(path)
+		if err != nil {
+			return err
+		}
+		if metadata != nil && metadata.RisingWaveVersion != "" {
+			fmt.Printf("The dump was taken from RisingWave %s, import the grafana dashboard of this version to view it\n", metadata.RisingWaveVersion)
+		}
 	} else {
 		files = []string{path}
 	}
 
-	pw := prompush.NewPushWorker(c.Context, vmEndpoint, batchSize, noop)
-	defer pw.Close()
+	// the checkpoint is not written in noop mode, as nothing is imported
+	var checkpoint *prompush.Checkpoint
+	if !noop {
+		if resume {
+			checkpoint, err = prompush.LoadCheckpoint(checkpointPath)
+			if err != nil {
+				return errors.Wrap(err, "failed to load checkpoint")
+			}
+			fmt.Printf("Resuming from checkpoint %s\n", checkpointPath)
+		} else {
+			checkpoint = prompush.NewCheckpoint(checkpointPath)
+			if err := checkpoint.Save(); err != nil {
+				return errors.Wrap(err, "failed to create checkpoint")
+			}
+		}
+	}
 
 	var pusher prompush.Pusher
 	if amp {
@@ -122,49 +250,202 @@ func runPush(c *cli.Context) error {
 		pusher = &prompush.NDJSONPusher{}
 	}
 
+	// a resumed run keeps the time shift of the previous run
+	var previousShift *time.Duration
+	if checkpoint != nil && resume {
+		previousShift = checkpoint.TimeShift
+	}
+	shiftSet := shiftBy != 0 || len(shiftTo) > 0
+	timeShift := shiftBy
+	if previousShift != nil && shiftTo == "now" && *previousShift != 0 {
+		// now has moved since the previous run
+		fmt.Printf("Warning: keeping the time shift %s of the previous run instead of shifting to now\n", *previousShift)
+		timeShift = *previousShift
+	} else if len(shiftTo) > 0 {
+		timeShift, err = calTimeShift(c, pusher, files, shiftTo, ignoreInvalidFiles)
+		if err != nil {
+			return errors.Wrap(err, "failed to calculate time shift")
+		}
+	}
+	if previousShift != nil {
+		if shiftSet && timeShift != *previousShift {
+			return fmt.Errorf("the time shift %s differs from the time shift %s of the previous run, resume without --shift-by and --shift-to, or start over without --resume", timeShift, *previousShift)
+		}
+		timeShift = *previousShift
+	} else if checkpoint != nil {
+		// recorded even if 0, so that a resume can't add a shift
+		checkpoint.TimeShift = &timeShift
+		if err := checkpoint.Save(); err != nil {
+			return errors.Wrap(err, "failed to update checkpoint")
+		}
+	}
+	if timeShift != 0 {
+		fmt.Printf("Shifting timestamps by %s\n", timeShift)
+	}
+	parseOpt := &prompush.ParseOpt{
+		TimeShift:   timeShift,
+		ShiftLabel:  c.String("shift-label"),
+		ExtraLabels: extraLabels,
+		LabelPrefix: labelPrefix,
+		NonFinite:   nonFinite,
+	}
+	stats := &prompush.ParseStats{}
+
+	cfg := &prompush.PushWorkerCfg{
+		Target:    target,
+		BatchSize: batchSize,
+	}
+	if checkpoint != nil {
+		cfg.OnFlush = checkpoint.Ack
+	}
+	pw := prompush.NewPushWorker(c.Context, cfg)
+	defer pw.Close()
+
 	for i, filename := range files {
+		key, err := filepath.Abs(filename)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path: %w", err)
+		}
+		var fc prompush.FileCheckpoint
+		if checkpoint != nil {
+			fc = checkpoint.Get(key)
+		}
+		if fc.Done {
+			fmt.Printf("\nSkipping %s (%d/%d), already imported\n", filename, i+1, len(files))
+			continue
+		}
+
 		fmt.Printf("\nPushing %s (%d/%d)\n", filename, i+1, len(files))
+		if fc.Line > 0 {
+			fmt.Printf("Skipping %d lines imported by the previous run\n", fc.Line)
+		}
 
-		file, err := os.Open(filename)
-		if err != nil {
-			return fmt.Errorf("failed to open file: %w", err)
+		if err := pushFile(c, pusher, pw, filename, &prompush.PushOpt{
+			File:               key,
+			SkipLines:          fc.Line,
+			IgnoreInvalidFiles: ignoreInvalidFiles,
+			Parse:              parseOpt,
+			Stats:              stats,
+		}); err != nil {
+			return err
+		}
+
+		// make sure every line of the file is acknowledged before marking it as done
+		if err := pw.Sync(c.Context); err != nil {
+			return errors.Wrap(err, "failed to flush data")
 		}
-		defer file.Close()
+		if checkpoint != nil {
+			if err := checkpoint.MarkDone(key); err != nil {
+				return errors.Wrap(err, "failed to update checkpoint")
+			}
+		}
+	}
 
-		fileInfo, err := file.Stat()
+	if err := pw.Sync(c.Context); err != nil {
+		return errors.Wrap(err, "failed to flush data")
+	}
+	fmt.Printf("\nPushed %s\n", stats)
+	return nil
+}
+
+// parseExtraLabels parses labels in the format name=value
+func parseExtraLabels(flags []string) (map[string]string, error) {
+	labels := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		name, value, ok := strings.Cut(flag, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid extra label %q, expect the format name=value", flag)
+		}
+		if !model.LabelName(name).IsValidLegacy() || name == model.MetricNameLabel {
+			return nil, fmt.Errorf("invalid extra label name: %s", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// calTimeShift calculates the shift that moves the last sample of all files to the target time
+func calTimeShift(c *cli.Context, pusher prompush.Pusher, files []string, shiftTo string, ignoreInvalidFiles bool) (time.Duration, error) {
+	target := time.Now()
+	if shiftTo != "now" {
+		t, err := time.Parse(time.RFC3339, shiftTo)
 		if err != nil {
-			return fmt.Errorf("failed to get file info: %w", err)
+			return 0, errors.Wrap(err, "failed to parse shift-to, expect `now` or RFC3339 format")
 		}
-		fileSize := fileInfo.Size()
+		target = t
+	}
 
-		var reader io.Reader
-		if strings.HasSuffix(filename, ".gz") {
-			gzReader, err := gzip.NewReader(file)
+	fmt.Println("Scanning files for the last timestamp...")
+	var last int64
+	for _, filename := range files {
+		ts, err := func() (int64, error) {
+			file, reader, err := openInput(filename)
 			if err != nil {
-				return fmt.Errorf("failed to create gzip reader: %w", err)
+				return 0, err
 			}
-			defer gzReader.Close()
-			reader = gzReader
-		} else {
-			reader = file
+			defer file.Close()
+			return pusher.LastTimestamp(c.Context, reader)
+		}()
+		if err != nil {
+			if ignoreInvalidFiles {
+				fmt.Printf("failed to scan %s, ignoring invalid file: %v\n", filename, err)
+				continue
+			}
+			return 0, errors.Wrapf(err, "failed to scan %s", filename)
 		}
+		last = max(last, ts)
+	}
+	if last == 0 {
+		return 0, fmt.Errorf("no samples found")
+	}
+	return target.Sub(time.UnixMilli(last)).Truncate(time.Millisecond), nil
+}
 
-		showProgress := func() error {
-			// Get current position in the compressed file
-			currentPos, err := file.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return fmt.Errorf("failed to get current file position: %w", err)
-			}
+// openInput opens the file, transparently decompressing .gz files. Closing
+// the returned file releases all resources.
+func openInput(filename string) (*os.File, io.Reader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return file, file, nil
+	}
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	return file, gzReader, nil
+}
 
-			// Display progress based on compressed file position
-			fmt.Printf("\033[2K\rprogress: %s", utils.RenderProgressBar(float32(currentPos)/float32(fileSize)))
-			return nil
-		}
+func pushFile(c *cli.Context, pusher prompush.Pusher, pw *prompush.PushWorker, filename string, opt *prompush.PushOpt) error {
+	file, reader, err := openInput(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		if err := pusher.Push(c.Context, reader, pw, showProgress, ignoreInvalidFiles); err != nil {
-			return errors.Wrap(err, "failed to push data")
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	fileSize := fileInfo.Size()
+
+	opt.ShowProgress = func() error {
+		// Get current position in the compressed file
+		currentPos, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get current file position: %w", err)
 		}
+
+		// Display progress based on compressed file position
+		fmt.Printf("\033[2K\rprogress: %s", utils.RenderProgressBar(float32(currentPos)/float32(fileSize)))
+		return nil
 	}
 
-	return pw.Flush(c.Context)
+	if err := pusher.Push(c.Context, reader, pw, opt); err != nil {
+		return errors.Wrap(err, "failed to push data")
+	}
+	return nil
 }
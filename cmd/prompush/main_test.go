@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/risingwavelabs/promdump/pkg/prompush"
+	"github.com/stretchr/testify/require"
+)
+
+// importServer is a VictoriaMetrics import API recording the imported lines.
+func importServer(t *testing.T) (*httptest.Server, func() []string) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func writeDump(t *testing.T, dir, name string, lines ...string) string {
+	var content string
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestResumeSkipsImported(t *testing.T) {
+	dir := t.TempDir()
+	done := writeDump(t, dir, "0.ndjson", `{"metric":{"__name__":"a"},"values":[[1,"1"]]}`)
+	partial := writeDump(t, dir, "1.ndjson",
+		`{"metric":{"__name__":"b"},"values":[[1,"1"]]}`,
+		`{"metric":{"__name__":"c"},"values":[[1,"1"]]}`,
+	)
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp := prompush.NewCheckpoint(checkpointPath)
+	require.NoError(t, cp.MarkDone(done))
+	require.NoError(t, cp.Ack(prompush.Position{File: partial, Line: 1}))
+
+	srv, imported := importServer(t)
+	err := newApp().Run([]string{"prompush", "-p", dir, "-e", srv.URL, "--resume", "--checkpoint", checkpointPath})
+	require.NoError(t, err)
+	require.Equal(t, []string{`{"metric":{"__name__":"c"},"values":[1],"timestamps":[1000]}`}, imported())
+
+	cp, err = prompush.LoadCheckpoint(checkpointPath)
+	require.NoError(t, err)
+	require.Equal(t, prompush.FileCheckpoint{Line: 2, Done: true}, cp.Get(partial))
+}
+
+func TestShiftToIgnoresInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeDump(t, dir, "invalid.json", `not json`)
+	writeDump(t, dir, "valid.json", `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"a"},"values":[[1,"1"],[5,"1"]]}]}}`)
+
+	srv, imported := importServer(t)
+	args := []string{"prompush", "-p", dir, "-e", srv.URL, "--amp", "--shift-to", "1970-01-01T00:00:10Z"}
+	require.Error(t, newApp().Run(args))
+	require.NoError(t, newApp().Run(append(args, "--ignore-invalid-files")))
+	// the last sample at 5s is shifted to 10s
+	require.Equal(t, []string{`{"metric":{"__name__":"a"},"values":[1,1],"timestamps":[6000,10000]}`}, imported())
+}
+
+func TestResumeWithDifferentTimeShift(t *testing.T) {
+	dir := t.TempDir()
+	writeDump(t, dir, "0.ndjson", `{"metric":{"__name__":"a"},"values":[[1,"1"]]}`)
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp := prompush.NewCheckpoint(checkpointPath)
+	shift := time.Hour
+	cp.TimeShift = &shift
+	require.NoError(t, cp.Save())
+
+	srv, imported := importServer(t)
+	args := []string{"prompush", "-p", dir, "-e", srv.URL, "--resume", "--checkpoint", checkpointPath}
+	require.ErrorContains(t, newApp().Run(append(args, "--shift-by", "2h")), "differs")
+	require.Empty(t, imported())
+
+	require.NoError(t, newApp().Run(append(args, "--shift-by", "1h")))
+	require.Equal(t, []string{`{"metric":{"__name__":"a"},"values":[1],"timestamps":[3601000]}`}, imported())
+}
+
+func TestResumeAddsTimeShift(t *testing.T) {
+	dir := t.TempDir()
+	writeDump(t, dir, "0.ndjson", `{"metric":{"__name__":"a"},"values":[[1,"1"]]}`)
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// the first run is not shifted, and records it
+	srv, imported := importServer(t)
+	args := []string{"prompush", "-p", dir, "-e", srv.URL, "--checkpoint", checkpointPath}
+	require.NoError(t, newApp().Run(args))
+	cp, err := prompush.LoadCheckpoint(checkpointPath)
+	require.NoError(t, err)
+	require.NotNil(t, cp.TimeShift)
+	require.Zero(t, *cp.TimeShift)
+
+	args = append(args, "--resume")
+	require.ErrorContains(t, newApp().Run(append(args, "--shift-by", "1h")), "differs")
+	require.ErrorContains(t, newApp().Run(append(args, "--shift-to", "now")), "differs")
+	require.NoError(t, newApp().Run(args))
+	require.Len(t, imported(), 1)
+}
+
+func TestParseExtraLabels(t *testing.T) {
+	labels, err := parseExtraLabels([]string{"env=prod", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod", "empty": ""}, labels)
+
+	for _, flag := range []string{"env", "=prod", "1env=prod", "__name__=up"} {
+		_, err := parseExtraLabels([]string{flag})
+		require.Error(t, err, flag)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	type request struct {
+		path, orgID string
+	}
+	var (
+		mu       sync.Mutex
+		requests []request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{r.URL.Path, r.Header.Get("X-Scope-OrgID")})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeDump(t, dir, "0.ndjson", `{"metric":{"__name__":"a"},"values":[[1,"1"]]}`)
+
+	// the tenant of a VictoriaMetrics cluster is in the path of vminsert
+	require.NoError(t, newApp().Run([]string{"prompush", "-p", dir, "-e", srv.URL, "--tenant", "1:2"}))
+	require.Equal(t, []request{{"/insert/1:2/prometheus/api/v1/import", ""}}, requests)
+
+	requests = nil
+	require.NoError(t, newApp().Run([]string{"prompush", "-p", dir, "--remote-write-url", srv.URL + "/api/v1/push", "--tenant", "team-a"}))
+	require.Equal(t, []request{{"/api/v1/push", "team-a"}}, requests)
+
+	require.ErrorContains(t, newApp().Run([]string{"prompush", "-p", dir, "-e", srv.URL, "--tenant", "team-a"}), "invalid VictoriaMetrics tenant")
+	require.ErrorContains(t, newApp().Run([]string{"prompush", "-p", dir, "-e", srv.URL + "/insert/1/prometheus", "--tenant", "1"}), "already has a tenant")
+}
@@ -0,0 +1,148 @@
+package promdump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/api"
+)
+
+// Backends of Prometheus compatible endpoints known by promdump.
+const (
+	BackendPrometheus      = "prometheus"
+	BackendThanos          = "thanos"
+	BackendMimir           = "mimir" // Mimir or Cortex
+	BackendVictoriaMetrics = "victoriametrics"
+	BackendGMP             = "gmp" // Google Cloud Managed Prometheus
+)
+
+// Sources of the samples of a dump.
+const (
+	// SourceQueryRange queries the samples with the range query API at every step
+	SourceQueryRange = "query-range"
+	// SourceVMExport streams the raw samples from the /api/v1/export API of VictoriaMetrics
+	SourceVMExport = "vm-export"
+)
+
+// Capabilities are the query capabilities of a backend.
+type Capabilities struct {
+	Backend string
+	// MaxPoints is the maximum number of points per series of a range query
+	MaxPoints int
+	// ArbitrarySelectors reports whether selectors without a metric name, like
+	// {__name__=~"a|b"} or the ones of --query, are allowed
+	ArbitrarySelectors bool
+	// Export is the source of the fastest export API of the backend, empty if
+	// there is none but the query API, see SourceVMExport
+	Export string
+}
+
+var backendCapabilities = map[string]Capabilities{
+	BackendPrometheus:      {MaxPoints: PrometheusDefaultMaxResolution, ArbitrarySelectors: true},
+	BackendThanos:          {MaxPoints: PrometheusDefaultMaxResolution, ArbitrarySelectors: true},
+	BackendMimir:           {MaxPoints: PrometheusDefaultMaxResolution, ArbitrarySelectors: true},
+	BackendVictoriaMetrics: {MaxPoints: 30_000, ArbitrarySelectors: true, Export: SourceVMExport}, // -search.maxPointsPerTimeseries
+	BackendGMP:             {MaxPoints: PrometheusDefaultMaxResolution},
+}
+
+// BackendCapabilities returns the default capabilities of the backend.
+func BackendCapabilities(backend string) (*Capabilities, error) {
+	c, ok := backendCapabilities[backend]
+	if !ok {
+		return nil, errors.Errorf("unknown backend %s", backend)
+	}
+	c.Backend = backend
+	return &c, nil
+}
+
+// capabilities returns the capabilities of opt, which default to the ones of Prometheus.
+func (opt *DumpOpt) capabilities() *Capabilities {
+	if opt.Capabilities != nil {
+		return opt.Capabilities
+	}
+	c, _ := BackendCapabilities(BackendPrometheus)
+	return c
+}
+
+// DetectBackend probes the endpoint of opt to identify its backend, and
+// returns its capabilities. Endpoints that can't be identified are assumed
+// to be Prometheus.
+func DetectBackend(ctx context.Context, opt *DumpOpt) (*Capabilities, error) {
+	backend, err := detectBackend(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return BackendCapabilities(backend)
+}
+
+func detectBackend(ctx context.Context, opt *DumpOpt) (string, error) {
+	if strings.Contains(opt.address(), "monitoring.googleapis.com") || strings.Contains(opt.address(), "/location/global/prometheus") {
+		return BackendGMP, nil
+	}
+	client, err := newAPIClient(opt)
+	if err != nil {
+		return "", err
+	}
+
+	// Mimir and Cortex name themselves in the build info, VictoriaMetrics
+	// and Thanos mimic Prometheus
+	body, err := probe(ctx, client, "/api/v1/status/buildinfo")
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		var buildinfo struct {
+			Data struct {
+				Application string `json:"application"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &buildinfo); err == nil {
+			app := strings.ToLower(buildinfo.Data.Application)
+			if strings.Contains(app, "mimir") || strings.Contains(app, "cortex") {
+				return BackendMimir, nil
+			}
+		}
+	}
+
+	// known paths of the other backends
+	if body, err := probe(ctx, client, "/api/v1/status/active_queries"); err != nil {
+		return "", err
+	} else if body != nil {
+		return BackendVictoriaMetrics, nil
+	}
+	if body, err := probe(ctx, client, "/api/v1/stores"); err != nil {
+		return "", err
+	} else if body != nil {
+		return BackendThanos, nil
+	}
+	return BackendPrometheus, nil
+}
+
+// probe gets the path of the endpoint, it returns a nil body if the path
+// doesn't exist.
+func probe(ctx context.Context, client api.Client, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.URL(path, nil).String(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request of %s", path)
+	}
+	resp, body, err := client.Do(ctx, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	return body, nil
+}
+
+func (c *Capabilities) String() string {
+	export := c.Export
+	if export == "" {
+		export = "none"
+	}
+	return fmt.Sprintf("backend %s, max points %d, arbitrary selectors %t, export API %s", c.Backend, c.MaxPoints, c.ArbitrarySelectors, export)
+}
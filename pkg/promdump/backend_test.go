@@ -0,0 +1,61 @@
+package promdump
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		paths   map[string]string
+		backend string
+	}{
+		{
+			name:    "prometheus",
+			paths:   map[string]string{"/api/v1/status/buildinfo": `{"status":"success","data":{"version":"2.53.0"}}`},
+			backend: BackendPrometheus,
+		},
+		{
+			name:    "mimir",
+			paths:   map[string]string{"/api/v1/status/buildinfo": `{"status":"success","data":{"application":"Grafana Mimir","version":"2.14.0"}}`},
+			backend: BackendMimir,
+		},
+		{
+			name: "victoriametrics",
+			paths: map[string]string{
+				"/api/v1/status/buildinfo":      `{"status":"success","data":{"version":"2.24.0"}}`,
+				"/api/v1/status/active_queries": `{"status":"ok","data":[]}`,
+			},
+			backend: BackendVictoriaMetrics,
+		},
+		{
+			name:    "thanos",
+			paths:   map[string]string{"/api/v1/stores": `{"status":"success","data":{}}`},
+			backend: BackendThanos,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handlers := make(map[string]http.HandlerFunc)
+			for path, body := range tc.paths {
+				handlers[path] = bodyHandler(body)
+			}
+			srv := newFakeProm(t, handlers)
+
+			c, err := DetectBackend(context.Background(), &DumpOpt{Endpoint: srv.URL})
+			require.NoError(t, err)
+			require.Equal(t, tc.backend, c.Backend)
+		})
+	}
+
+	c, err := DetectBackend(context.Background(), &DumpOpt{Endpoint: "https://monitoring.googleapis.com/v1/projects/p/location/global/prometheus"})
+	require.NoError(t, err)
+	require.Equal(t, BackendGMP, c.Backend)
+	require.False(t, c.ArbitrarySelectors)
+
+	_, err = BackendCapabilities("influxdb")
+	require.Error(t, err)
+}
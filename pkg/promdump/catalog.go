@@ -0,0 +1,193 @@
+package promdump
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed catalog
+var embeddedCatalog embed.FS
+
+// catalog holds the dashboards and metrics names of RisingWave versions, see catalog/README.md
+var catalog fs.FS = mustSub(embeddedCatalog, "catalog")
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// CatalogVersion is a RisingWave version known by promdump.
+type CatalogVersion struct {
+	Version string
+	// Dashboard and Metrics report whether the dashboard and the metrics names are embedded
+	Dashboard bool
+	Metrics   bool
+	// Cached reports whether the dashboard has been fetched to the local cache
+	Cached bool
+}
+
+// Versions returns the RisingWave versions of the embedded catalog and of the
+// local cache, from the newest to the oldest.
+func Versions() ([]CatalogVersion, error) {
+	versions := make(map[string]*CatalogVersion)
+	get := func(version string) *CatalogVersion {
+		if _, ok := versions[version]; !ok {
+			versions[version] = &CatalogVersion{Version: version}
+		}
+		return versions[version]
+	}
+
+	dashboards, err := fs.Glob(catalog, "dashboards/*.json")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list embedded dashboards")
+	}
+	for _, f := range dashboards {
+		get(strings.TrimSuffix(path.Base(f), ".json")).Dashboard = true
+	}
+	metrics, err := fs.Glob(catalog, "metrics/*.txt")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list embedded metrics names")
+	}
+	for _, f := range metrics {
+		get(strings.TrimSuffix(path.Base(f), ".txt")).Metrics = true
+	}
+	if dir, err := cacheDir(); err == nil {
+		cached, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, f := range cached {
+			get(strings.TrimSuffix(filepath.Base(f), ".json")).Cached = true
+		}
+	}
+
+	var ret []CatalogVersion
+	for _, v := range versions {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return compareVersions(ret[i].Version, ret[j].Version) > 0
+	})
+	return ret, nil
+}
+
+// compareVersions compares versions like v2.6.2 or v2.10.0-rc.1 like semver:
+// the numeric components of the release first, then a pre-release sorts
+// below its release. Other components are compared as strings.
+func compareVersions(a, b string) int {
+	releaseA, preA, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	releaseB, preB, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	if c := compareIdentifiers(strings.Split(releaseA, "."), strings.Split(releaseB, ".")); c != 0 {
+		return c
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareIdentifiers(strings.Split(preA, "."), strings.Split(preB, "."))
+}
+
+// compareIdentifiers compares dot separated version identifiers, numeric
+// identifiers numerically and below the others, which are compared as strings.
+func compareIdentifiers(pa, pb []string) int {
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return cmp.Compare(na, nb)
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		case pa[i] != pb[i]:
+			return strings.Compare(pa[i], pb[i])
+		}
+	}
+	return cmp.Compare(len(pa), len(pb))
+}
+
+// cacheDir is where the dashboards fetched from GitHub are cached.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get user cache directory")
+	}
+	return filepath.Join(dir, "promdump", "dashboards"), nil
+}
+
+// githubDashboardURL is the URL of the dashboard of a RisingWave version on GitHub
+var githubDashboardURL = "https://raw.githubusercontent.com/risingwavelabs/risingwave/refs/tags/%s/grafana/risingwave-dev-dashboard.json"
+
+// readLocalVersion returns the dashboard of the RisingWave version from the
+// embedded catalog or the local cache, in this order.
+func readLocalVersion(version string) ([]byte, error) {
+	if strings.ContainsAny(version, `/\`) {
+		return nil, fmt.Errorf("invalid version %s", version)
+	}
+	if content, err := fs.ReadFile(catalog, "dashboards/"+version+".json"); err == nil {
+		return content, nil
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, version+".json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "no dashboard of version %s in the catalog or the cache", version)
+	}
+	return content, nil
+}
+
+// fetchVersion fetches the dashboard of the RisingWave version from GitHub,
+// and caches it, as tags don't change.
+func fetchVersion(version string) ([]byte, error) {
+	if strings.ContainsAny(version, `/\`) {
+		return nil, fmt.Errorf("invalid version %s", version)
+	}
+	content, err := readFromURL(fmt.Sprintf(githubDashboardURL, version))
+	if err != nil {
+		return nil, err
+	}
+	if dir, err := cacheDir(); err == nil {
+		// the cache is best effort
+		if err := os.MkdirAll(dir, 0755); err == nil {
+			_ = os.WriteFile(filepath.Join(dir, version+".json"), content, 0644)
+		}
+	}
+	return content, nil
+}
+
+// readMetricsFromCatalog returns the embedded metrics names of the RisingWave version.
+func readMetricsFromCatalog(version string) ([]string, error) {
+	content, err := fs.ReadFile(catalog, "metrics/"+version+".txt")
+	if err != nil {
+		return nil, errors.Wrapf(err, "no metrics names of version %s in the catalog", version)
+	}
+	var metrics []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			metrics = append(metrics, line)
+		}
+	}
+	return metrics, scanner.Err()
+}
@@ -0,0 +1,119 @@
+package promdump
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		if r.URL.Path != "/v2.8.0.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"panels": [{"id": 1, "targets": [{"expr": "barrier_latency"}]}]}`)
+	}))
+	defer srv.Close()
+
+	original, originalURL := catalog, githubDashboardURL
+	defer func() { catalog, githubDashboardURL = original, originalURL }()
+	githubDashboardURL = srv.URL + "/%s.json"
+	catalog = fstest.MapFS{
+		"dashboards/v2.6.2.json": {Data: []byte(`{"panels": [{"id": 1, "targets": [{"expr": "up"}]}]}`)},
+		"metrics/v2.6.2.txt":     {Data: []byte("up\n")},
+		"metrics/v2.10.0.txt":    {Data: []byte("# exported\nup\nhummock_size\n\n")},
+	}
+	dir, err := cacheDir()
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v2.7.0.json"), []byte(`{"panels": [{"id": 1, "targets": [{"expr": "stream_rows"}]}]}`), 0644))
+
+	versions, err := Versions()
+	require.NoError(t, err)
+	require.Equal(t, []CatalogVersion{
+		{Version: "v2.10.0", Metrics: true},
+		{Version: "v2.7.0", Cached: true},
+		{Version: "v2.6.2", Dashboard: true, Metrics: true},
+	}, versions)
+
+	// embedded dashboard
+	result, err := NewGrafanaDashboardParser().Parse("v2.6.2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"up"}, result.Metrics)
+
+	// cached dashboard
+	result, err = NewGrafanaDashboardParser().Parse("v2.7.0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"stream_rows"}, result.Metrics)
+
+	// embedded metrics names, without fetching the dashboard
+	result, err = NewGrafanaDashboardParser().Parse("v2.10.0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"hummock_size", "up"}, result.Metrics)
+
+	// GitHub, then the local cache
+	result, err = NewGrafanaDashboardParser().Parse("v2.8.0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"barrier_latency"}, result.Metrics)
+	result, err = NewGrafanaDashboardParser().Parse("v2.8.0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"barrier_latency"}, result.Metrics)
+	require.Equal(t, []string{"/v2.8.0.json"}, fetched)
+
+	_, err = NewGrafanaDashboardParser().Parse("v2.9.0")
+	require.ErrorContains(t, err, "failed to read grafana dashboard from version v2.9.0")
+
+	// the metrics names can't be filtered by panel, the dashboard is needed
+	filter, err := NewPanelFilter("1")
+	require.NoError(t, err)
+	parser := NewGrafanaDashboardParser()
+	parser.PanelFilters = []*PanelFilter{filter}
+	_, err = parser.Parse("v2.10.0")
+	require.ErrorContains(t, err, "failed to read grafana dashboard from version v2.10.0")
+	parser = NewGrafanaDashboardParser()
+	parser.Strict = true
+	_, err = parser.Parse("v2.10.0")
+	require.ErrorContains(t, err, "failed to read grafana dashboard from version v2.10.0")
+	require.Equal(t, []string{"/v2.8.0.json", "/v2.9.0.json", "/v2.10.0.json", "/v2.10.0.json"}, fetched)
+
+	// the embedded dashboard is filtered like any dashboard
+	parser = NewGrafanaDashboardParser()
+	parser.PanelFilters = []*PanelFilter{filter}
+	result, err = parser.Parse("v2.6.2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"up"}, result.Metrics)
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v2.6.2", "v2.6.2", 0},
+		{"v2.10.0", "v2.9.1", 1},
+		{"v2.6.2", "v2.6", 1},
+		{"v2.10.0-rc.1", "v2.10.0", -1},
+		{"v2.10.0", "v2.10.0-rc.1", 1},
+		{"v2.10.0-alpha", "v2.10.0-rc.1", -1},
+		{"v2.10.0-rc.2", "v2.10.0-rc.10", -1},
+		{"v2.10.0-rc.1", "v2.9.0", 1},
+		{"v2.10.0-alpha", "v2.10.0-alpha.1", -1},
+		{"v2.10.0-1", "v2.10.0-alpha", -1},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, compareVersions(tt.a, tt.b), "%s %s", tt.a, tt.b)
+	}
+}
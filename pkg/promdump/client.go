@@ -0,0 +1,84 @@
+package promdump
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/api"
+)
+
+// address returns the base URL of the Prometheus API, which is the datasource
+// proxy of Grafana if GrafanaURL is set.
+func (opt *DumpOpt) address() string {
+	if opt.GrafanaURL == "" {
+		return opt.Endpoint
+	}
+	return strings.TrimSuffix(opt.GrafanaURL, "/") + "/api/datasources/proxy/uid/" + url.PathEscape(opt.DatasourceUID)
+}
+
+func newAPIClient(opt *DumpOpt) (api.Client, error) {
+	client, err := api.NewClient(api.Config{
+		Address: opt.address(),
+		Client:  newHTTPClient(opt),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create prometheus client")
+	}
+	return client, nil
+}
+
+// newHTTPClient returns the HTTP client of the requests to the endpoint, for
+// the APIs the Prometheus client doesn't cover.
+func newHTTPClient(opt *DumpOpt) *http.Client {
+	header := http.Header{}
+	// the token is a Grafana credential, never send it to a plain endpoint
+	if opt.GrafanaURL != "" && opt.GrafanaToken != "" {
+		header.Set("Authorization", "Bearer "+opt.GrafanaToken)
+	}
+	if opt.Tenant != "" {
+		header.Set("X-Scope-OrgID", opt.Tenant)
+	}
+	params := url.Values{}
+	if opt.Dedup != nil {
+		params.Set("dedup", strconv.FormatBool(*opt.Dedup))
+	}
+	if opt.PartialResponse != nil {
+		params.Set("partial_response", strconv.FormatBool(*opt.PartialResponse))
+	}
+	if opt.MaxSourceResolution != "" {
+		params.Set("max_source_resolution", opt.MaxSourceResolution)
+	}
+
+	var rt http.RoundTripper = http.DefaultTransport
+	if len(header) > 0 || len(params) > 0 {
+		rt = &headerRoundTripper{header: header, params: params, next: rt}
+	}
+	return &http.Client{Transport: rt}
+}
+
+// headerRoundTripper sets the headers and adds the URL query parameters to
+// every request. Prometheus compatible APIs read the parameters of both the
+// URL and the form of POST requests.
+type headerRoundTripper struct {
+	header http.Header
+	params url.Values
+	next   http.RoundTripper
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range h.header {
+		req.Header[name] = values
+	}
+	if len(h.params) > 0 {
+		query := req.URL.Query()
+		for name, values := range h.params {
+			query[name] = values
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return h.next.RoundTrip(req)
+}
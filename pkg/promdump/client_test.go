@@ -0,0 +1,82 @@
+package promdump
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpThroughGrafanaProxy(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"*": matrixHandler(`{"metric":{"__name__":"up"},"values":[[1,"1"]]}`),
+	})
+
+	var buf bytes.Buffer
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		GrafanaURL:    srv.URL + "/",
+		DatasourceUID: "prom",
+		GrafanaToken:  "secret",
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(60, 0),
+		Step:          time.Second,
+		MetricsNames:  []string{"up"},
+		MemoryRatio:   1,
+	}, &buf, nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"metric":{"__name__":"up"},"values":[[1,"1"]]}`, buf.String())
+	require.Equal(t, []string{"/api/datasources/proxy/uid/prom/api/v1/query_range"}, srv.Paths())
+	require.Equal(t, "Bearer secret", srv.Requests("")[0].Header.Get("Authorization"))
+}
+
+func TestGrafanaTokenNotSentToEndpoint(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{"*": matrixHandler("")})
+
+	// e.g. GRAFANA_TOKEN is set in the environment but no Grafana URL is given
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoint:     srv.URL,
+		GrafanaToken: "secret",
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"up"},
+		MemoryRatio:  1,
+	}, io.Discard, nil)
+	require.NoError(t, err)
+	requests := srv.Requests("")
+	require.Len(t, requests, 1)
+	require.Empty(t, requests[0].Header.Get("Authorization"))
+}
+
+func TestDumpWithQueryOptions(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/label/__name__/values": dataHandler(`["up"]`),
+		"/api/v1/query_range":           matrixHandler(""),
+	})
+
+	dedup, partialResponse := false, true
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoint:            srv.URL,
+		Start:               time.Unix(0, 0),
+		End:                 time.Unix(60, 0),
+		Step:                time.Second,
+		MetricsPatterns:     []string{"u.*"},
+		MemoryRatio:         1,
+		Tenant:              "team-a",
+		Dedup:               &dedup,
+		PartialResponse:     &partialResponse,
+		MaxSourceResolution: "5m",
+	}, io.Discard, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/api/v1/label/__name__/values", "/api/v1/query_range"}, srv.Paths())
+	for _, r := range srv.Requests("") {
+		require.Equal(t, "team-a", r.Header.Get("X-Scope-OrgID"))
+		require.Equal(t, "false", r.Form.Get("dedup"))
+		require.Equal(t, "true", r.Form.Get("partial_response"))
+		require.Equal(t, "5m", r.Form.Get("max_source_resolution"))
+	}
+}
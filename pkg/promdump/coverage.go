@@ -0,0 +1,159 @@
+package promdump
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	prom_model "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// coverageBatchSize is the number of metrics whose series are counted by one request
+const coverageBatchSize = 20
+
+// MetricCoverage is a metric of the endpoint with its number of series.
+type MetricCoverage struct {
+	Metric string `json:"metric" yaml:"metric"`
+	Series int    `json:"series" yaml:"series"`
+}
+
+// Coverage compares the metrics needed, e.g. by a dashboard, with the metrics
+// of an endpoint.
+type Coverage struct {
+	// Present are the needed metrics found in the endpoint
+	Present []MetricCoverage `json:"present" yaml:"present"`
+	// PatternMatched are the metrics of the endpoint that are not needed by
+	// name, but match a pattern of the needed metrics
+	PatternMatched []MetricCoverage `json:"pattern_matched" yaml:"pattern_matched"`
+	// Missing are the needed metrics not found in the endpoint
+	Missing []string `json:"missing" yaml:"missing"`
+	// Extra are the metrics of the endpoint that are not needed
+	Extra []MetricCoverage `json:"extra" yaml:"extra"`
+}
+
+// MissingRatio is the ratio of the needed metrics that are missing, the
+// metrics matching patterns are not counted.
+func (c *Coverage) MissingRatio() float64 {
+	total := len(c.Present) + len(c.Missing)
+	if total == 0 {
+		return 0
+	}
+	return float64(len(c.Missing)) / float64(total)
+}
+
+// CheckCoverage compares the metrics with the metric names of the endpoint of
+// opt during its time range, restricted to the series matching opt.Selector.
+// The metrics of the endpoint matching any of the patterns are reported
+// separately, they are neither missing nor extra.
+func CheckCoverage(ctx context.Context, opt *DumpOpt, metrics []string, patterns []string) (*Coverage, error) {
+	client, err := newAPIClient(opt)
+	if err != nil {
+		return nil, err
+	}
+	v1api := v1.NewAPI(client)
+
+	matchers, err := selectorMatchers(opt.Selector)
+	if err != nil {
+		return nil, err
+	}
+	var labelMatches []string
+	if opt.Selector != "" {
+		labelMatches = []string{opt.Selector}
+	}
+	labelValues, _, err := v1api.LabelValues(ctx, "__name__", labelMatches, opt.Start, opt.End)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get metrics names")
+	}
+	available := make(map[string]struct{})
+	for _, v := range labelValues {
+		available[string(v)] = struct{}{}
+	}
+	var regexes []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid metrics pattern %s", pattern)
+		}
+		regexes = append(regexes, re)
+	}
+
+	var (
+		coverage                       Coverage
+		present, patternMatched, extra []string
+		needed                         = make(map[string]struct{})
+	)
+	for _, metric := range metrics {
+		if metric == "" {
+			continue
+		}
+		needed[metric] = struct{}{}
+		if _, ok := available[metric]; ok {
+			present = append(present, metric)
+		} else {
+			coverage.Missing = append(coverage.Missing, metric)
+		}
+	}
+	for metric := range available {
+		if _, ok := needed[metric]; ok {
+			continue
+		}
+		matched := false
+		for _, re := range regexes {
+			if re.MatchString(metric) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			patternMatched = append(patternMatched, metric)
+		} else {
+			extra = append(extra, metric)
+		}
+	}
+
+	all := append(append(append([]string(nil), present...), patternMatched...), extra...)
+	counts, err := countSeries(ctx, v1api, all, matchers, opt.Start, opt.End)
+	if err != nil {
+		return nil, err
+	}
+	coverage.Present = metricCoverages(present, counts)
+	coverage.PatternMatched = metricCoverages(patternMatched, counts)
+	coverage.Extra = metricCoverages(extra, counts)
+	sort.Strings(coverage.Missing)
+	return &coverage, nil
+}
+
+// metricCoverages returns the metrics with their series counts, sorted by name.
+func metricCoverages(metrics []string, counts map[string]int) []MetricCoverage {
+	sort.Strings(metrics)
+	var ret []MetricCoverage
+	for _, metric := range metrics {
+		ret = append(ret, MetricCoverage{Metric: metric, Series: counts[metric]})
+	}
+	return ret
+}
+
+// countSeries counts the series of the metrics matching the matchers with
+// the series API, in batches of coverageBatchSize metrics.
+func countSeries(ctx context.Context, v1api v1.API, metrics []string, matchers []*labels.Matcher, start, end time.Time) (map[string]int, error) {
+	sort.Strings(metrics)
+	counts := make(map[string]int)
+	for i := 0; i < len(metrics); i += coverageBatchSize {
+		selector, err := namesSelector(metrics[i:min(i+coverageBatchSize, len(metrics))], matchers)
+		if err != nil {
+			return nil, err
+		}
+		series, _, err := v1api.Series(ctx, []string{selector}, start, end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get series")
+		}
+		for _, s := range series {
+			counts[string(s[prom_model.MetricNameLabel])]++
+		}
+	}
+	return counts, nil
+}
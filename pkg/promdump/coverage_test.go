@@ -0,0 +1,56 @@
+package promdump
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCoverage(t *testing.T) {
+	var series []labels.Labels
+	add := func(name, namespace string, n int) {
+		for i := 0; i < n; i++ {
+			series = append(series, labels.FromStrings("__name__", name, "namespace", namespace, "i", string(rune('a'+i))))
+		}
+	}
+	add("up", "rw", 3)
+	add("up", "other", 5)
+	add("stream_rows", "rw", 2)
+	add("stream_barrier", "rw", 1)
+	add("go_goroutines", "rw", 4)
+	add("node_load1", "other", 1)
+
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/series":                seriesHandler(series),
+		"/api/v1/label/__name__/values": seriesHandler(series),
+	})
+
+	coverage, err := CheckCoverage(context.Background(), &DumpOpt{
+		Endpoint: srv.URL,
+		Start:    time.Unix(0, 0),
+		End:      time.Unix(60, 0),
+		Selector: `{namespace="rw"}`,
+		Tenant:   "team-a",
+	}, []string{"up", "hummock_size"}, []string{"stream_.*"})
+	require.NoError(t, err)
+	require.Equal(t, &Coverage{
+		Present:        []MetricCoverage{{Metric: "up", Series: 3}},
+		PatternMatched: []MetricCoverage{{Metric: "stream_barrier", Series: 1}, {Metric: "stream_rows", Series: 2}},
+		Missing:        []string{"hummock_size"},
+		Extra:          []MetricCoverage{{Metric: "go_goroutines", Series: 4}},
+	}, coverage)
+	// the metrics matching patterns are not needed by name
+	require.Equal(t, 0.5, coverage.MissingRatio())
+
+	// the series of all metrics are counted in one request
+	require.Equal(t, []string{"/api/v1/label/__name__/values", "/api/v1/series"}, srv.Paths())
+	for _, r := range srv.Requests("") {
+		require.Equal(t, "team-a", r.Header.Get("X-Scope-OrgID"))
+	}
+	require.Equal(t, []string{`{namespace="rw"}`}, srv.Values("/api/v1/label/__name__/values", "match[]"))
+	require.Equal(t, []string{`{__name__=~"go_goroutines|stream_barrier|stream_rows|up",namespace="rw"}`}, srv.Values("/api/v1/series", "match[]"))
+}
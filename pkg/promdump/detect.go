@@ -0,0 +1,68 @@
+package promdump
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// versionSelectors select the RisingWave series that may hold the version,
+// in order of preference: the build info style metrics of RisingWave, e.g.
+// risingwave_build_info, then any series of a RisingWave component. Series of
+// other components like prometheus_build_info have versions of their own.
+var versionSelectors = []string{
+	`{__name__=~"risingwave.*build_info.*"}`,
+	`{job=~".*(meta|compute|frontend|compactor).*"}`,
+}
+
+// versionLabels are the labels that may hold the RisingWave version
+var versionLabels = []string{"version", "risingwave_version", "rw_version", "git_version"}
+
+// versionRegex matches a RisingWave version like v2.6.2 or 2.6.0-rc.1 in a label value
+var versionRegex = regexp.MustCompile(`v?(\d+\.\d+\.\d+(?:-[0-9A-Za-z.]+)?)`)
+
+// DetectRisingWaveVersion returns the RisingWave version of the endpoint of
+// opt during its time range, from the version labels of the RisingWave build
+// info metrics, or of any RisingWave series. If several versions are found,
+// e.g. because of an upgrade, the newest one is returned.
+func DetectRisingWaveVersion(ctx context.Context, opt *DumpOpt) (string, error) {
+	client, err := newAPIClient(opt)
+	if err != nil {
+		return "", err
+	}
+	v1api := v1.NewAPI(client)
+
+	for _, selector := range versionSelectors {
+		versions := make(map[string]struct{})
+		for _, label := range versionLabels {
+			values, _, err := v1api.LabelValues(ctx, label, []string{selector}, opt.Start, opt.End)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to get values of label %s", label)
+			}
+			for _, value := range values {
+				if m := versionRegex.FindStringSubmatch(string(value)); m != nil {
+					versions["v"+m[1]] = struct{}{}
+				}
+			}
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		var sorted []string
+		for version := range versions {
+			sorted = append(sorted, version)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return compareVersions(sorted[i], sorted[j]) > 0
+		})
+		if len(sorted) > 1 {
+			fmt.Printf("Warning: found RisingWave versions %v, using the newest one\n", sorted)
+		}
+		return sorted[0], nil
+	}
+	return "", errors.New("no RisingWave version found in the version labels of the RisingWave series of the endpoint")
+}
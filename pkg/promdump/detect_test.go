@@ -0,0 +1,66 @@
+package promdump
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// versionServer returns the values of the version label for the given
+// selectors, and the version of prometheus_build_info for any other selector.
+func versionServer(t *testing.T, values map[string]string) *fakeProm {
+	return newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/label/version/values": func(w http.ResponseWriter, r *http.Request) {
+			data, ok := values[r.Form.Get("match[]")]
+			if !ok {
+				data = `["3.5.0"]`
+			}
+			dataHandler(data)(w, r)
+		},
+		"*": dataHandler("[]"),
+	})
+}
+
+func TestDetectRisingWaveVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   string
+	}{
+		{
+			name:   "build info",
+			values: map[string]string{versionSelectors[0]: `["2.5.1 (abcdef)", "v2.6.2", "v2.10.0-rc.1"]`},
+			want:   "v2.10.0-rc.1",
+		},
+		{
+			name:   "release after its pre-release",
+			values: map[string]string{versionSelectors[0]: `["v2.10.0", "v2.10.0-rc.1", "v2.9.3"]`},
+			want:   "v2.10.0",
+		},
+		{
+			name:   "component series",
+			values: map[string]string{versionSelectors[0]: `[]`, versionSelectors[1]: `["v2.6.2"]`},
+			want:   "v2.6.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// prometheus_build_info has a higher version than RisingWave
+			srv := versionServer(t, tt.values)
+			version, err := DetectRisingWaveVersion(context.Background(), &DumpOpt{
+				Endpoint: srv.URL,
+				Start:    time.Unix(0, 0),
+				End:      time.Unix(60, 0),
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, version)
+		})
+	}
+
+	srv := versionServer(t, map[string]string{versionSelectors[0]: `[]`, versionSelectors[1]: `[]`})
+	_, err := DetectRisingWaveVersion(context.Background(), &DumpOpt{Endpoint: srv.URL})
+	require.ErrorContains(t, err, "no RisingWave version found")
+}
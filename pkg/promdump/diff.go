@@ -0,0 +1,201 @@
+package promdump
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+)
+
+// MetricsDiff is the difference between the metrics of two parse results,
+// e.g. of two versions of a dashboard.
+type MetricsDiff struct {
+	Added   []string `json:"added" yaml:"added"`
+	Removed []string `json:"removed" yaml:"removed"`
+	// AddedPanels and RemovedPanels are the locations of the panels with
+	// queries only in the new or the old result, e.g. `Streaming / panel 6 "Up"`
+	AddedPanels   []string `json:"added_panels" yaml:"added_panels"`
+	RemovedPanels []string `json:"removed_panels" yaml:"removed_panels"`
+	// Changed are the queries whose expressions changed, a renamed metric is
+	// usually both removed and added, with the panels using it changed
+	Changed []QueryDiff `json:"changed" yaml:"changed"`
+}
+
+// QueryDiff is a panel, variable, annotation or rule whose expressions changed.
+type QueryDiff struct {
+	// Location is the location of the query without the panel id, which may
+	// change between versions, e.g. `Streaming / panel "Throughput"`
+	Location string   `json:"location" yaml:"location"`
+	Old      []string `json:"old" yaml:"old"`
+	New      []string `json:"new" yaml:"new"`
+}
+
+// DiffMetrics compares the metrics and the expressions of the queries of two
+// parse results. Panels are matched by id, row and title, then by row and
+// title, as ids may change between versions, then by id. Their targets are
+// matched by ref id, including the targets that could not be analysed or
+// have no metric. Other queries are matched by their location.
+func DiffMetrics(from, to *ParseResult) *MetricsDiff {
+	diff := &MetricsDiff{}
+	oldMetrics, newMetrics := toSet(from.Metrics), toSet(to.Metrics)
+	for _, metric := range to.Metrics {
+		if _, ok := oldMetrics[metric]; !ok {
+			diff.Added = append(diff.Added, metric)
+		}
+	}
+	for _, metric := range from.Metrics {
+		if _, ok := newMetrics[metric]; !ok {
+			diff.Removed = append(diff.Removed, metric)
+		}
+	}
+
+	diffPanels(diff, from.Panels, to.Panels)
+	oldExprs, newExprs := exprsByLocation(from), exprsByLocation(to)
+	for location, newSet := range newExprs {
+		oldSet, ok := oldExprs[location]
+		if !ok || equalSets(oldSet, newSet) {
+			continue
+		}
+		diff.Changed = append(diff.Changed, QueryDiff{
+			Location: location,
+			Old:      sortedKeys(oldSet),
+			New:      sortedKeys(newSet),
+		})
+	}
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Location < diff.Changed[j].Location
+	})
+	return diff
+}
+
+// diffPanels adds the added, removed and changed panels to the diff.
+func diffPanels(diff *MetricsDiff, from, to []PanelQueries) {
+	oldMatched, newMatched := make([]bool, len(from)), make([]bool, len(to))
+	match := func(same func(a, b *PanelQueries) bool) {
+		for j := range to {
+			for i := range from {
+				if newMatched[j] || oldMatched[i] || !same(&from[i], &to[j]) {
+					continue
+				}
+				oldMatched[i], newMatched[j] = true, true
+				if !maps.Equal(targetsByRefID(&from[i]), targetsByRefID(&to[j])) {
+					diff.Changed = append(diff.Changed, QueryDiff{
+						Location: panelLocation(&to[j], false),
+						Old:      targetExprs(&from[i]),
+						New:      targetExprs(&to[j]),
+					})
+				}
+			}
+		}
+	}
+	match(func(a, b *PanelQueries) bool { return a.ID == b.ID && a.Row == b.Row && a.Title == b.Title })
+	match(func(a, b *PanelQueries) bool { return a.Row == b.Row && a.Title == b.Title })
+	match(func(a, b *PanelQueries) bool { return a.ID == b.ID })
+
+	for i := range from {
+		if !oldMatched[i] {
+			diff.RemovedPanels = append(diff.RemovedPanels, panelLocation(&from[i], true))
+		}
+	}
+	for j := range to {
+		if !newMatched[j] {
+			diff.AddedPanels = append(diff.AddedPanels, panelLocation(&to[j], true))
+		}
+	}
+}
+
+// panelLocation is the location of the panel, e.g. `Streaming / panel 3 "CPU"`.
+func panelLocation(panel *PanelQueries, withID bool) string {
+	location := fmt.Sprintf("panel %q", panel.Title)
+	if withID {
+		location = fmt.Sprintf("panel %d %q", panel.ID, panel.Title)
+	}
+	if panel.Row != "" {
+		location = panel.Row + " / " + location
+	}
+	return location
+}
+
+// targetExprs returns the expressions of the targets of the panel.
+func targetExprs(panel *PanelQueries) []string {
+	var exprs []string
+	for _, target := range panel.Targets {
+		if target.Query != "" {
+			exprs = append(exprs, target.Query)
+		}
+	}
+	return exprs
+}
+
+// targetsByRefID returns the expressions of the targets of the panel by their
+// ref id, or by their index if they have none.
+func targetsByRefID(panel *PanelQueries) map[string]string {
+	ret := make(map[string]string)
+	for i, target := range panel.Targets {
+		if target.Query == "" {
+			continue
+		}
+		key := target.RefID
+		if key == "" {
+			key = fmt.Sprintf("#%d", i)
+		}
+		ret[key] = target.Query
+	}
+	return ret
+}
+
+// exprsByLocation groups the expressions of the queries of the result other
+// than panels by their location, including the failures.
+func exprsByLocation(result *ParseResult) map[string]map[string]struct{} {
+	ret := make(map[string]map[string]struct{})
+	add := func(u *Usage) {
+		if u.Expr == "" || u.Source == "panel" {
+			return
+		}
+		location := u.Location()
+		if parent := u.Row + u.Group; parent != "" {
+			location = parent + " / " + location
+		}
+		if _, ok := ret[location]; !ok {
+			ret[location] = make(map[string]struct{})
+		}
+		ret[location][u.Expr] = struct{}{}
+	}
+	for _, lineage := range result.Lineage {
+		for i := range lineage.Usages {
+			add(&lineage.Usages[i])
+		}
+	}
+	for i := range result.Failures {
+		add(&result.Failures[i].Usage)
+	}
+	return ret
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func equalSets(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+package promdump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffMetrics(t *testing.T) {
+	dir := t.TempDir()
+	parse := func(name, content string) *ParseResult {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		result, err := NewGrafanaDashboardParser().Parse(path)
+		require.NoError(t, err)
+		return result
+	}
+	from := parse("old.json", `{"panels": [
+		{"id": 1, "type": "row", "title": "Streaming"},
+		{"id": 2, "title": "Throughput", "targets": [{"refId": "A", "expr": "rate(stream_x[1m])"}]},
+		{"id": 3, "title": "Up", "targets": [{"refId": "A", "expr": "up"}]},
+		{"id": 4, "title": "Broken", "targets": [{"refId": "A", "expr": "sum(up"}]},
+		{"id": 7, "title": "Constant", "targets": [{"refId": "A", "expr": "vector(1)"}]},
+		{"id": 8, "title": "Gone", "targets": [{"refId": "A", "expr": "up"}]}
+	]}`)
+	to := parse("new.json", `{"panels": [
+		{"id": 1, "type": "row", "title": "Streaming"},
+		{"id": 5, "title": "Throughput", "targets": [{"refId": "A", "expr": "rate(stream_rows[1m])"}]},
+		{"id": 6, "title": "Up", "targets": [{"refId": "A", "expr": "up"}]},
+		{"id": 4, "title": "Fixed", "targets": [{"refId": "A", "expr": "sum(up)"}]},
+		{"id": 7, "title": "Constant", "targets": [{"refId": "A", "expr": "vector(2)"}]},
+		{"id": 9, "title": "New", "targets": [{"refId": "A", "expr": "up"}, {"refId": "B", "expr": "stream_rows"}]}
+	]}`)
+
+	require.Equal(t, &MetricsDiff{
+		Added:         []string{"stream_rows"},
+		Removed:       []string{"stream_x"},
+		AddedPanels:   []string{`Streaming / panel 9 "New"`},
+		RemovedPanels: []string{`Streaming / panel 8 "Gone"`},
+		Changed: []QueryDiff{{
+			// a query without metric
+			Location: `Streaming / panel "Constant"`,
+			Old:      []string{"vector(1)"},
+			New:      []string{"vector(2)"},
+		}, {
+			// a query that can't be parsed, matched by id as the title changed
+			Location: `Streaming / panel "Fixed"`,
+			Old:      []string{"sum(up"},
+			New:      []string{"sum(up)"},
+		}, {
+			// matched by title as the id changed
+			Location: `Streaming / panel "Throughput"`,
+			Old:      []string{"rate(stream_x[1m])"},
+			New:      []string{"rate(stream_rows[1m])"},
+		}},
+	}, DiffMetrics(from, to))
+}
@@ -0,0 +1,110 @@
+package promdump
+
+import (
+	"sort"
+
+	prom_model "github.com/prometheus/common/model"
+)
+
+// endpointOpts returns the options of every endpoint of opt.
+func (opt *DumpOpt) endpointOpts() []*DumpOpt {
+	if len(opt.Endpoints) == 0 {
+		return []*DumpOpt{opt}
+	}
+	ret := make([]*DumpOpt, len(opt.Endpoints))
+	for i, endpoint := range opt.Endpoints {
+		eopt := *opt
+		eopt.Endpoint, eopt.Endpoints = endpoint, nil
+		ret[i] = &eopt
+	}
+	return ret
+}
+
+// seriesMerger merges the series of a query from several endpoints, one time
+// range after another. Series with the same labels, e.g. from an HA pair, are
+// merged into one, and the samples of the first endpoint win on the same
+// timestamps.
+type seriesMerger struct {
+	// sourceLabel is set to the first endpoint, in the order they are added,
+	// that returned the series in the first time range it appeared in, if not
+	// empty. sources keeps it for the next time ranges of the query, so that
+	// the source of a series of an HA pair doesn't change between them.
+	sourceLabel string
+	sources     map[prom_model.Fingerprint]string
+	series      map[prom_model.Fingerprint]*prom_model.SampleStream
+	order       []prom_model.Fingerprint
+}
+
+func newSeriesMerger(sourceLabel string) *seriesMerger {
+	return &seriesMerger{
+		sourceLabel: sourceLabel,
+		sources:     make(map[prom_model.Fingerprint]string),
+		series:      make(map[prom_model.Fingerprint]*prom_model.SampleStream),
+	}
+}
+
+func (m *seriesMerger) add(matrix prom_model.Matrix, endpoint string) {
+	for _, s := range matrix {
+		fp := s.Metric.Fingerprint()
+		existing, ok := m.series[fp]
+		if !ok {
+			source, ok := m.sources[fp]
+			if !ok && m.sourceLabel != "" {
+				source = endpoint
+				m.sources[fp] = source
+			}
+			s.Metric = tagSource(s.Metric, m.sourceLabel, source)
+			m.series[fp] = s
+			m.order = append(m.order, fp)
+			continue
+		}
+		existing.Values = mergeByTimestamp(existing.Values, s.Values, func(s prom_model.SamplePair) prom_model.Time {
+			return s.Timestamp
+		})
+		existing.Histograms = mergeByTimestamp(existing.Histograms, s.Histograms, func(s prom_model.SampleHistogramPair) prom_model.Time {
+			return s.Timestamp
+		})
+	}
+}
+
+// flush returns the merged series of the time range, and resets the merger
+// for the next one.
+func (m *seriesMerger) flush() prom_model.Matrix {
+	ret := make(prom_model.Matrix, len(m.order))
+	for i, fp := range m.order {
+		ret[i] = m.series[fp]
+	}
+	m.series = make(map[prom_model.Fingerprint]*prom_model.SampleStream)
+	m.order = nil
+	return ret
+}
+
+// tagSource returns the metric with the label set to the endpoint, the metric
+// is returned as is if label is empty.
+func tagSource(metric prom_model.Metric, label, endpoint string) prom_model.Metric {
+	if label == "" {
+		return metric
+	}
+	ret := metric.Clone()
+	ret[prom_model.LabelName(label)] = prom_model.LabelValue(endpoint)
+	return ret
+}
+
+// mergeByTimestamp adds the samples of b to a, except the ones on the
+// timestamps of a, and sorts them by timestamp.
+func mergeByTimestamp[T any](a, b []T, timestamp func(T) prom_model.Time) []T {
+	if len(b) == 0 {
+		return a
+	}
+	seen := make(map[prom_model.Time]struct{}, len(a))
+	for _, s := range a {
+		seen[timestamp(s)] = struct{}{}
+	}
+	for _, s := range b {
+		if _, ok := seen[timestamp(s)]; !ok {
+			a = append(a, s)
+		}
+	}
+	sort.Slice(a, func(i, j int) bool { return timestamp(a[i]) < timestamp(a[j]) })
+	return a
+}
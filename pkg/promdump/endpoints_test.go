@@ -0,0 +1,156 @@
+package promdump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prom_model "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpMultipleEndpoints(t *testing.T) {
+	// an HA pair, the second replica missed a scrape and has a series of its own
+	a := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/query_range": matrixHandler(`{"metric":{"__name__":"up","job":"rw"},"values":[[1,"1"],[2,"1"]]}`),
+	})
+	b := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/query_range": matrixHandler(`{"metric":{"__name__":"up","job":"rw"},"values":[[2,"0"],[3,"1"]]},{"metric":{"__name__":"up","job":"meta"},"values":[[1,"1"]]}`),
+	})
+
+	var buf bytes.Buffer
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoints:    []string{a.URL, b.URL},
+		SourceLabel:  "promdump_source",
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"up"},
+		MemoryRatio:  1,
+	}, &buf, nil)
+	require.NoError(t, err)
+
+	lines := strings.Split(buf.String(), "\n")
+	require.Len(t, lines, 2)
+	require.JSONEq(t, fmt.Sprintf(`{"metric":{"__name__":"up","job":"rw","promdump_source":%q},"values":[[1,"1"],[2,"1"],[3,"1"]]}`, a.URL), lines[0])
+	require.JSONEq(t, fmt.Sprintf(`{"metric":{"__name__":"up","job":"meta","promdump_source":%q},"values":[[1,"1"]]}`, b.URL), lines[1])
+}
+
+func TestDumpMultipleEndpointsBatches(t *testing.T) {
+	// newServer serves the series of the metrics
+	newServer := func(counts map[string]int) *fakeProm {
+		var series []labels.Labels
+		for metric, n := range counts {
+			for i := 0; i < n; i++ {
+				series = append(series, labels.FromStrings("__name__", metric, "i", fmt.Sprint(i)))
+			}
+		}
+		return newFakeProm(t, map[string]http.HandlerFunc{
+			"/api/v1/series":      seriesHandler(series),
+			"/api/v1/query_range": matrixHandler(""),
+		})
+	}
+	// the series counts differ, batches planned per endpoint would differ as well
+	a := newServer(map[string]int{"a": 2, "b": 2})
+	b := newServer(map[string]int{"a": 1, "b": 5, "c": 1})
+
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoints:      []string{a.URL, b.URL},
+		Start:          time.Unix(0, 0),
+		End:            time.Unix(60, 0),
+		Step:           time.Second,
+		MetricsNames:   []string{"a", "b", "c"},
+		BatchMaxSeries: 4,
+		MemoryRatio:    1,
+	}, io.Discard, nil)
+	require.NoError(t, err)
+	// every metric is queried once, with the most series of any endpoint
+	want := []string{`b`, `{__name__=~"a|c"}`}
+	require.Equal(t, want, a.Values("/api/v1/query_range", "query"))
+	require.Equal(t, want, b.Values("/api/v1/query_range", "query"))
+}
+
+func TestDumpMultipleEndpointsPerTimeRange(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	// the requests of both endpoints in order
+	newServer := func(name string) *fakeProm {
+		return newFakeProm(t, map[string]http.HandlerFunc{
+			"/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, name+" "+r.Form.Get("start"))
+				mu.Unlock()
+				matrixHandler(fmt.Sprintf(`{"metric":{"__name__":"up"},"values":[[%s,"1"]]}`, r.Form.Get("start")))(w, r)
+			},
+		})
+	}
+	a := newServer("a")
+	b := newServer("b")
+
+	var matrices []prom_model.Matrix
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoints:    []string{a.URL, b.URL},
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"up"},
+		MemoryRatio:  1,
+		Capabilities: &Capabilities{Backend: BackendPrometheus, MaxPoints: 40, ArbitrarySelectors: true},
+	}, io.Discard, func(_ string, matrix prom_model.Matrix, _ float32) error {
+		matrices = append(matrices, matrix)
+		return nil
+	})
+	require.NoError(t, err)
+	// the endpoints are merged one time range after another, not for the whole query
+	require.Equal(t, []string{"a 0", "b 0", "a 40", "b 40"}, requests)
+	require.Len(t, matrices, 2)
+	require.Equal(t, prom_model.Time(0), matrices[0][0].Values[0].Timestamp)
+	require.Equal(t, prom_model.Time(40000), matrices[1][0].Values[0].Timestamp)
+}
+
+func TestDumpMultipleEndpointsStableSource(t *testing.T) {
+	// the first endpoint, e.g. a replica started late, only has the series in the second time range
+	a := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			if r.Form.Get("start") == "0" {
+				matrixHandler("")(w, r)
+				return
+			}
+			matrixHandler(`{"metric":{"__name__":"up"},"values":[[40,"1"]]}`)(w, r)
+		},
+	})
+	b := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			matrixHandler(fmt.Sprintf(`{"metric":{"__name__":"up"},"values":[[%s,"1"]]}`, r.Form.Get("start")))(w, r)
+		},
+	})
+
+	var sources []string
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoints:    []string{a.URL, b.URL},
+		SourceLabel:  "promdump_source",
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"up"},
+		MemoryRatio:  1,
+		Capabilities: &Capabilities{Backend: BackendPrometheus, MaxPoints: 40, ArbitrarySelectors: true},
+	}, io.Discard, func(_ string, matrix prom_model.Matrix, _ float32) error {
+		for _, s := range matrix {
+			sources = append(sources, string(s.Metric["promdump_source"]))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	// the series keeps the endpoint it first came from in every time range
+	require.Equal(t, []string{b.URL, b.URL}, sources)
+}
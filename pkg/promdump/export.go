@@ -0,0 +1,76 @@
+package promdump
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// exportVM streams the raw samples of the queries of opt from the
+// /api/v1/export API of VictoriaMetrics to w. The lines are in the JSON line
+// format of the VictoriaMetrics import API, which prompush reads as is.
+func exportVM(ctx context.Context, opt *DumpOpt, w io.Writer, cb QueryCallback) error {
+	opt = opt.endpointOpts()[0]
+	client, err := newAPIClient(opt)
+	if err != nil {
+		return err
+	}
+	queries, err := buildQueries(ctx, []v1.API{v1.NewAPI(client)}, opt)
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(opt)
+	for qi, query := range queries {
+		if err := exportQuery(ctx, httpClient, opt, query, w); err != nil {
+			return err
+		}
+		if cb != nil {
+			if err := cb(query, nil, float32(qi+1)/float32(len(queries))); err != nil {
+				return errors.Wrapf(err, "failed to run callback")
+			}
+		}
+	}
+	return nil
+}
+
+func exportQuery(ctx context.Context, client *http.Client, opt *DumpOpt, query string, w io.Writer) error {
+	// both bounds are inclusive, the parts of a multipart dump end before
+	// the next one starts, see DumpMultipart
+	params := url.Values{
+		"match[]": []string{query},
+		"start":   []string{exportTime(opt.Start)},
+		"end":     []string{exportTime(opt.End)},
+	}
+	u := strings.TrimSuffix(opt.address(), "/") + "/api/v1/export?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create export request")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to export %s", query)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("failed to export %s: %s: %s", query, resp.Status, strings.TrimSpace(string(body)))
+	}
+	// every line ends with a newline, so the lines of the queries don't need a separator
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return errors.Wrapf(err, "failed to write the export of %s", query)
+	}
+	return nil
+}
+
+// exportTime formats the time as Unix seconds with a millisecond precision.
+func exportTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1e3, 'f', 3, 64)
+}
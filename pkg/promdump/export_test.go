@@ -0,0 +1,68 @@
+package promdump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	prom_model "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportVM(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/export": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"metric":{"__name__":%q},"values":[1,2],"timestamps":[1000,2000]}`+"\n", r.Form.Get("match[]"))
+		},
+	})
+
+	var buf bytes.Buffer
+	var progress []float32
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoint:     srv.URL,
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"up", "stream_rows"},
+		Source:       SourceVMExport,
+	}, &buf, func(query string, _ prom_model.Matrix, value float32) error {
+		progress = append(progress, value)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"metric":{"__name__":"up"},"values":[1,2],"timestamps":[1000,2000]}
+{"metric":{"__name__":"stream_rows"},"values":[1,2],"timestamps":[1000,2000]}
+`, buf.String())
+	require.Equal(t, []float32{0.5, 1}, progress)
+	// the end of a single dump is inclusive
+	var requests []string
+	for _, r := range srv.Requests("") {
+		requests = append(requests, fmt.Sprintf("%s %s %s", r.Path, r.Form.Get("start"), r.Form.Get("end")))
+	}
+	require.Equal(t, []string{"/api/v1/export 0.000 60.000", "/api/v1/export 0.000 60.000"}, requests)
+}
+
+func TestExportVMMultipart(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/export": bodyHandler(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}` + "\n"),
+	})
+	err := DumpMultipart(context.Background(), &DumpMultipartCfg{
+		Opt: &DumpOpt{
+			Endpoint:     srv.URL,
+			Start:        time.Unix(0, 0),
+			End:          time.Unix(120, 0),
+			Step:         time.Second,
+			MetricsNames: []string{"up"},
+			Source:       SourceVMExport,
+		},
+		Parts:     2,
+		OutputDir: t.TempDir(),
+	}, nil)
+	require.NoError(t, err)
+	// adjacent parts don't both export the samples of the boundary, the last one includes the end
+	require.Equal(t, []string{"0.000", "60.000"}, srv.Values("/api/v1/export", "start"))
+	require.Equal(t, []string{"59.999", "120.000"}, srv.Values("/api/v1/export", "end"))
+}
@@ -0,0 +1,142 @@
+package promdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// fakeProm is a fake Prometheus HTTP API serving a handler per path, which
+// records the requests it receives. Paths without handler are not found.
+type fakeProm struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []fakeRequest
+}
+
+// fakeRequest is a request received by a fakeProm, with its parsed form.
+type fakeRequest struct {
+	Path   string
+	Form   url.Values
+	Header http.Header
+}
+
+func newFakeProm(t *testing.T, handlers map[string]http.HandlerFunc) *fakeProm {
+	f := &fakeProm{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, fakeRequest{Path: r.URL.Path, Form: r.Form, Header: r.Header})
+		f.mu.Unlock()
+		handler, ok := handlers[r.URL.Path]
+		if !ok {
+			handler = handlers["*"]
+		}
+		if handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Requests returns the requests received for the path, all of them if path is empty.
+func (f *fakeProm) Requests(path string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ret []fakeRequest
+	for _, r := range f.requests {
+		if path == "" || r.Path == path {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// Values returns the form values of key of the requests received for the path.
+func (f *fakeProm) Values(path, key string) []string {
+	var ret []string
+	for _, r := range f.Requests(path) {
+		ret = append(ret, r.Form.Get(key))
+	}
+	return ret
+}
+
+// Paths returns the paths of all requests received.
+func (f *fakeProm) Paths() []string {
+	var ret []string
+	for _, r := range f.Requests("") {
+		ret = append(ret, r.Path)
+	}
+	return ret
+}
+
+// bodyHandler responds with the body.
+func bodyHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, body)
+	}
+}
+
+// matrixHandler responds to range queries with the series of the matrix,
+// given as the JSON of its elements.
+func matrixHandler(result string) http.HandlerFunc {
+	return bodyHandler(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, result))
+}
+
+// dataHandler responds with the JSON of data as a successful API response.
+func dataHandler(data string) http.HandlerFunc {
+	return bodyHandler(fmt.Sprintf(`{"status":"success","data":%s}`, data))
+}
+
+// seriesHandler responds to the series API with the series matching the
+// match[] selectors, and to the label values API of __name__ with their names.
+func seriesHandler(series []labels.Labels) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var matchers []*labels.Matcher
+		for _, m := range r.Form["match[]"] {
+			ms, err := parser.ParseMetricSelector(m)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			matchers = append(matchers, ms...)
+		}
+		data := []any{}
+		names := make(map[string]bool)
+		for _, s := range series {
+			if !matchAll(matchers, s) {
+				continue
+			}
+			if r.URL.Path == "/api/v1/series" {
+				data = append(data, s.Map())
+			} else if name := s.Get("__name__"); !names[name] {
+				names[name] = true
+				data = append(data, name)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+	}
+}
+
+func matchAll(matchers []*labels.Matcher, lset labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
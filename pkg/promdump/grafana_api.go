@@ -0,0 +1,91 @@
+package promdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isGrafanaURL reports whether the dashboard is read from the HTTP API of a
+// Grafana instance, with one of the forms:
+//   - grafana://host/uid/<uid> for a single dashboard
+//   - grafana://host/search?tag=<tag>&folderUIDs=<uid> for the dashboards
+//     matching the parameters of the search API
+//
+// grafana:// uses HTTPS, grafana+http:// uses plain HTTP. The host may include
+// a port and the path prefix of Grafana, e.g. grafana://host:3000/grafana/uid/<uid>.
+func isGrafanaURL(dashboard string) bool {
+	return strings.HasPrefix(dashboard, "grafana://") || strings.HasPrefix(dashboard, "grafana+http://")
+}
+
+// readFromGrafana returns the dashboards referenced by the grafana URL.
+func readFromGrafana(dashboard string, token string) ([][]byte, error) {
+	u, err := url.Parse(dashboard)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid grafana URL")
+	}
+	base := url.URL{Scheme: "https", Host: u.Host}
+	if u.Scheme == "grafana+http" {
+		base.Scheme = "http"
+	}
+
+	if prefix, uid, ok := strings.Cut(u.Path, "/uid/"); ok && uid != "" {
+		base.Path = prefix
+		content, err := getGrafana(base, "/api/dashboards/uid/"+uid, nil, token)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{content}, nil
+	}
+	if prefix, ok := strings.CutSuffix(u.Path, "/search"); ok {
+		base.Path = prefix
+		return searchGrafana(base, u.Query(), token)
+	}
+	return nil, fmt.Errorf("invalid grafana URL %s, expected grafana://host/uid/<uid> or grafana://host/search?<parameters>", dashboard)
+}
+
+// searchGrafana returns the dashboards found by the search API.
+func searchGrafana(base url.URL, query url.Values, token string) ([][]byte, error) {
+	query.Set("type", "dash-db")
+	content, err := getGrafana(base, "/api/search", query, token)
+	if err != nil {
+		return nil, err
+	}
+	var hits []struct {
+		UID string `json:"uid"`
+	}
+	if err := json.Unmarshal(content, &hits); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal grafana search result")
+	}
+	if len(hits) == 0 {
+		return nil, errors.New("no grafana dashboard matches the search")
+	}
+
+	var contents [][]byte
+	for _, hit := range hits {
+		content, err := getGrafana(base, "/api/dashboards/uid/"+hit.UID, nil, token)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read grafana dashboard %s", hit.UID)
+		}
+		contents = append(contents, content)
+	}
+	return contents, nil
+}
+
+func getGrafana(base url.URL, path string, query url.Values, token string) ([]byte, error) {
+	base.Path = strings.TrimSuffix(base.Path, "/") + path
+	base.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", base.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return readRequest(req)
+}
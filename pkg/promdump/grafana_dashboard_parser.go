@@ -6,7 +6,9 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strings"
+	"regexp"
+	"sort"
+	"strconv"
 
 	"github.com/pkg/errors"
 
@@ -14,105 +16,415 @@ import (
 )
 
 type GrafanaDashboardParser struct {
-	set map[string]struct{}
+	// Strict makes Parse fail on the first query that can't be parsed,
+	// instead of reporting it in ParseResult.Failures
+	Strict bool
+	// RowFilters and PanelFilters restrict the panels to analyse, a panel is
+	// analysed if it is in a row matching any row filter, and matches any
+	// panel filter. Variables and annotations are always analysed.
+	RowFilters   []*PanelFilter
+	PanelFilters []*PanelFilter
+	// GrafanaToken is the API token used to read dashboards from Grafana
+	GrafanaToken string
+	// RecordedSeries makes ParseRules include the series written by recording rules
+	RecordedSeries bool
+
+	usages   map[string]map[Usage]struct{}
+	patterns map[string]struct{}
+	failures []ParseFailure
+	panels   []PanelQueries
 }
 
 func NewGrafanaDashboardParser() *GrafanaDashboardParser {
 	return &GrafanaDashboardParser{
-		set: make(map[string]struct{}),
+		usages:   make(map[string]map[Usage]struct{}),
+		patterns: make(map[string]struct{}),
 	}
 }
 
 type Dashboard struct {
-	Panels []Panel `json:"panels"`
+	Title       string      `json:"title"`
+	Panels      []Panel     `json:"panels"`
+	Templating  Templating  `json:"templating"`
+	Annotations Annotations `json:"annotations"`
+}
+
+type Annotations struct {
+	List []Annotation `json:"list"`
+}
+
+type Annotation struct {
+	Name  string `json:"name"`
+	Query string `json:"expr"`
+	// Target is used instead of Query by newer Grafana versions
+	Target *Target `json:"target"`
 }
 
 type Panel struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	// Type is "row" for rows, the panels of collapsed rows are in Panels
+	Type    string   `json:"type"`
 	Panels  []Panel  `json:"panels"`
 	Targets []Target `json:"targets"`
 }
 
 type Target struct {
-	Query string `json:"expr"`
+	RefID string `json:"refId,omitempty" yaml:"ref_id,omitempty"`
+	Query string `json:"expr" yaml:"expr"`
 }
 
-func (p *GrafanaDashboardParser) Parse(dashboard string) ([]string, error) {
-	var (
-		content []byte
-		err     error
-	)
-	if isFilePath(dashboard) {
-		content, err = readFileContent(dashboard)
+// PanelQueries is a panel with queries, in a dashboard or a row.
+type PanelQueries struct {
+	Dashboard string   `json:"dashboard" yaml:"dashboard"`
+	Row       string   `json:"row,omitempty" yaml:"row,omitempty"`
+	ID        int      `json:"id" yaml:"id"`
+	Title     string   `json:"title" yaml:"title"`
+	Targets   []Target `json:"targets" yaml:"targets"`
+}
+
+// Usage is a query of a dashboard or a rules file.
+type Usage struct {
+	Dashboard string `json:"dashboard,omitempty" yaml:"dashboard,omitempty"`
+	// File and Group locate the rule of a rules file
+	File  string `json:"file,omitempty" yaml:"file,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Source is where the query is defined: panel, variable, annotation,
+	// alert or record. It is catalog for the metrics names of a version of
+	// the embedded catalog, which have no query.
+	Source     string `json:"source" yaml:"source"`
+	Row        string `json:"row,omitempty" yaml:"row,omitempty"`
+	PanelID    int    `json:"panel_id,omitempty" yaml:"panel_id,omitempty"`
+	PanelTitle string `json:"panel_title,omitempty" yaml:"panel_title,omitempty"`
+	// Name is the name of the variable, annotation, alert or recorded series
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	Expr string `json:"expr" yaml:"expr"`
+}
+
+// Location describes where the query is defined, e.g. `panel 3 "CPU"`.
+func (u *Usage) Location() string {
+	switch u.Source {
+	case "panel":
+		return fmt.Sprintf("panel %d %q", u.PanelID, u.PanelTitle)
+	case "catalog":
+		return "metrics names of the catalog"
+	default:
+		return fmt.Sprintf("%s %q", u.Source, u.Name)
+	}
+}
+
+// ParseFailure describes a query that could not be analysed.
+type ParseFailure struct {
+	Usage
+	Err error
+}
+
+func (f *ParseFailure) String() string {
+	return fmt.Sprintf("%s: %s: %v", f.Location(), f.Expr, f.Err)
+}
+
+// MetricLineage lists the queries using a metric.
+type MetricLineage struct {
+	Metric string  `json:"metric" yaml:"metric"`
+	Usages []Usage `json:"usages" yaml:"usages"`
+}
+
+type ParseResult struct {
+	// Metrics are sorted by name
+	Metrics []string
+	// Patterns are the regexes of the `metrics(regex)` variable queries.
+	// They can only be resolved against the metric names of an endpoint.
+	Patterns []string
+	// Lineage is sorted by metric name, and usages by dashboard and location
+	Lineage []MetricLineage
+	// Failures are the queries that could not be analysed, always empty in strict mode
+	Failures []ParseFailure
+	// Panels are the panels with queries selected by the filters, including
+	// their queries that could not be analysed or have no metric
+	Panels []PanelQueries
+}
+
+// PanelFilter matches a panel or row by id, or by a regex of its title.
+type PanelFilter struct {
+	id    int
+	title *regexp.Regexp
+}
+
+// NewPanelFilter returns a filter matching the id if s is a number, or the
+// title with s as an anchored regex otherwise.
+func NewPanelFilter(s string) (*PanelFilter, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return &PanelFilter{id: id}, nil
+	}
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid panel filter %s", s)
+	}
+	return &PanelFilter{title: re}, nil
+}
+
+func (f *PanelFilter) Match(panel *Panel) bool {
+	if f.title == nil {
+		return panel.ID == f.id
+	}
+	return f.title.MatchString(panel.Title)
+}
+
+func matchAny(filters []*PanelFilter, panel *Panel) bool {
+	for _, f := range filters {
+		if f.Match(panel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse retrieves the metrics names used by the dashboard. The result
+// accumulates the metrics of all dashboards parsed by this parser.
+// The dashboard is a file path, a RisingWave version, or a dashboard of a
+// Grafana instance, see isGrafanaURL.
+func (p *GrafanaDashboardParser) Parse(dashboard string) (*ParseResult, error) {
+	var contents [][]byte
+	switch {
+	case isFilePath(dashboard):
+		content, err := readFileContent(dashboard)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to read grafana dashboard from file %s, please specify a valid version or a file path", dashboard)
 		}
-	} else {
-		content, err = readFromVersion(dashboard)
+		contents = append(contents, content)
+	case isGrafanaURL(dashboard):
+		var err error
+		contents, err = readFromGrafana(dashboard, p.GrafanaToken)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read grafana dashboard from %s", dashboard)
+		}
+	default:
+		// the embedded catalog and the cache first, then GitHub
+		content, err := readLocalVersion(dashboard)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read grafana dashboard from version %s, please specify a valid version or a file path", dashboard)
+			// without the dashboard, the embedded metrics names of the version
+			// are enough, unless panels are filtered or queries must be parsed
+			if !p.Strict && len(p.RowFilters) == 0 && len(p.PanelFilters) == 0 {
+				if metrics, catalogErr := readMetricsFromCatalog(dashboard); catalogErr == nil {
+					for _, metric := range metrics {
+						p.addUsage(metric, Usage{Dashboard: dashboard, Source: "catalog"})
+					}
+					return p.result(), nil
+				}
+			}
+			content, err = fetchVersion(dashboard)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read grafana dashboard from version %s, please specify a valid version or a file path", dashboard)
+			}
 		}
+		contents = append(contents, content)
+	}
+	for _, content := range contents {
+		if err := p.parseDashboard(content, dashboard); err != nil {
+			return nil, err
+		}
+	}
+	return p.result(), nil
+}
+
+// parseDashboard parses the dashboard JSON, name is used if the dashboard has no title.
+func (p *GrafanaDashboardParser) parseDashboard(content []byte, name string) error {
+	// the dashboard API of Grafana wraps the dashboard with its metadata
+	var envelope struct {
+		Dashboard json.RawMessage `json:"dashboard"`
+	}
+	if err := json.Unmarshal(content, &envelope); err == nil && len(envelope.Dashboard) > 0 && envelope.Dashboard[0] == '{' {
+		content = envelope.Dashboard
 	}
 	var board Dashboard
 	if err := json.Unmarshal(content, &board); err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal grafana dashboard JSON")
+		return errors.Wrap(err, "failed to unmarshal grafana dashboard JSON")
+	}
+	if board.Title != "" {
+		name = board.Title
 	}
+	resolver := newTemplateResolver(&board.Templating)
+
+	// panels after an expanded row belong to it, collapsed rows contain their panels
+	var (
+		row         string
+		rowSelected = len(p.RowFilters) == 0
+	)
 	for _, panel := range board.Panels {
-		if err := p.fetchMetricsNamesFromPanel(&panel); err != nil {
-			return nil, err
+		if panel.Type == "row" {
+			row, rowSelected = panel.Title, len(p.RowFilters) == 0 || matchAny(p.RowFilters, &panel)
+		}
+		if err := p.fetchMetricsNamesFromPanel(&panel, Usage{Dashboard: name, Source: "panel", Row: row}, rowSelected, resolver); err != nil {
+			return err
 		}
 	}
-	var metrics []string
-	for metric := range p.set {
-		metrics = append(metrics, metric)
+	// metrics used by variables and annotations are needed to render the dashboard as well
+	for _, variable := range board.Templating.List {
+		if err := p.fetchMetricsNamesFromVariable(&variable, Usage{Dashboard: name, Source: "variable", Name: variable.Name}, resolver); err != nil {
+			return err
+		}
+	}
+	for _, annotation := range board.Annotations.List {
+		usage := Usage{Dashboard: name, Source: "annotation", Name: annotation.Name, Expr: annotation.Query}
+		if usage.Expr == "" && annotation.Target != nil {
+			usage.Expr = annotation.Target.Query
+		}
+		if err := p.fetchMetricsNamesFromQuery(usage, resolver); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return metrics, nil
+func (p *GrafanaDashboardParser) result() *ParseResult {
+	result := &ParseResult{
+		Failures: p.failures,
+		Panels:   p.panels,
+	}
+	for metric, usages := range p.usages {
+		result.Metrics = append(result.Metrics, metric)
+		lineage := MetricLineage{Metric: metric}
+		for usage := range usages {
+			lineage.Usages = append(lineage.Usages, usage)
+		}
+		sort.Slice(lineage.Usages, func(i, j int) bool {
+			a, b := lineage.Usages[i], lineage.Usages[j]
+			if a.Dashboard != b.Dashboard {
+				return a.Dashboard < b.Dashboard
+			}
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			if a.Group != b.Group {
+				return a.Group < b.Group
+			}
+			if a.Source != b.Source {
+				return a.Source < b.Source
+			}
+			if a.PanelID != b.PanelID {
+				return a.PanelID < b.PanelID
+			}
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return a.Expr < b.Expr
+		})
+		result.Lineage = append(result.Lineage, lineage)
+	}
+	sort.Strings(result.Metrics)
+	sort.Slice(result.Lineage, func(i, j int) bool {
+		return result.Lineage[i].Metric < result.Lineage[j].Metric
+	})
+	for pattern := range p.patterns {
+		result.Patterns = append(result.Patterns, pattern)
+	}
+	sort.Strings(result.Patterns)
+	return result
+}
+
+// fail records the failure, or returns it as an error in strict mode
+func (p *GrafanaDashboardParser) fail(f ParseFailure) error {
+	if p.Strict {
+		return errors.New(f.String())
+	}
+	p.failures = append(p.failures, f)
+	return nil
 }
 
-func cleanQuery(s string) string {
-	s = strings.ReplaceAll(s, "$__interval", "5m")
-	s = strings.ReplaceAll(s, "$__rate_interval", "5m")
-	s = strings.Map(func(r rune) rune {
-		if strings.ContainsRune("$", r) {
-			return -1
+// fetchMetricsNamesFromQuery records the metrics used by usage.Expr. A query
+// that can't be parsed is recorded as a failure, see fail.
+func (p *GrafanaDashboardParser) fetchMetricsNamesFromQuery(usage Usage, resolver *templateResolver) error {
+	if usage.Expr == "" {
+		return nil
+	}
+	resolved, patterns, err := resolver.resolve(usage.Expr)
+	if err != nil {
+		return p.fail(ParseFailure{Usage: usage, Err: errors.Wrap(err, "failed to resolve dashboard variables")})
+	}
+	expr, err := parser.ParseExpr(resolved)
+	if err != nil {
+		return p.fail(ParseFailure{Usage: usage, Err: errors.Wrap(err, "failed to parse PromQL expression")})
+	}
+	for _, pattern := range patterns {
+		p.patterns[pattern] = struct{}{}
+	}
+	for _, metric := range extractMetrics(expr) {
+		if metric != placeholderMetric {
+			p.addUsage(metric, usage)
 		}
-		return r
-	}, s)
-	return s
+	}
+	return nil
+}
+
+func (p *GrafanaDashboardParser) addUsage(metric string, usage Usage) {
+	if _, ok := p.usages[metric]; !ok {
+		p.usages[metric] = make(map[Usage]struct{})
+	}
+	p.usages[metric][usage] = struct{}{}
 }
 
-func (p *GrafanaDashboardParser) fetchMetricsNamesFromPanel(panel *Panel) error {
-	for _, target := range panel.Targets {
-		if target.Query == "" {
-			continue
+func (p *GrafanaDashboardParser) fetchMetricsNamesFromVariable(variable *Variable, usage Usage, resolver *templateResolver) error {
+	if variable.Type != "query" {
+		return nil
+	}
+	exprs, pattern := parseVariableQuery(variable.QueryString())
+	for _, expr := range exprs {
+		usage.Expr = expr
+		if err := p.fetchMetricsNamesFromQuery(usage, resolver); err != nil {
+			return err
 		}
-		expr, err := parser.ParseExpr(cleanQuery(target.Query))
-		if err != nil {
-			return errors.Wrapf(err, "failed to parse PromQL expression: %s", target.Query)
+	}
+	if pattern != "" {
+		p.patterns[resolver.resolveRegex(pattern)] = struct{}{}
+	}
+	return nil
+}
+
+func (p *GrafanaDashboardParser) fetchMetricsNamesFromPanel(panel *Panel, usage Usage, rowSelected bool, resolver *templateResolver) error {
+	if panel.Type == "row" {
+		usage.Row = panel.Title
+		rowSelected = len(p.RowFilters) == 0 || matchAny(p.RowFilters, panel)
+	}
+	usage.PanelID, usage.PanelTitle = panel.ID, panel.Title
+	if rowSelected && len(panel.Targets) > 0 && (len(p.PanelFilters) == 0 || matchAny(p.PanelFilters, panel)) {
+		p.panels = append(p.panels, PanelQueries{
+			Dashboard: usage.Dashboard,
+			Row:       usage.Row,
+			ID:        panel.ID,
+			Title:     panel.Title,
+			Targets:   panel.Targets,
+		})
+		for _, target := range panel.Targets {
+			usage.Expr = target.Query
+			if err := p.fetchMetricsNamesFromQuery(usage, resolver); err != nil {
+				return err
+			}
 		}
-		p.extractMetrics(expr)
 	}
 
 	for _, panel := range panel.Panels {
-		if err := p.fetchMetricsNamesFromPanel(&panel); err != nil {
+		if err := p.fetchMetricsNamesFromPanel(&panel, usage, rowSelected, resolver); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (p *GrafanaDashboardParser) extractMetrics(expr parser.Expr) {
+// extractMetrics returns the names of the metrics selected by the expression.
+func extractMetrics(expr parser.Expr) []string {
+	var names []string
 	parser.Inspect(expr, func(n parser.Node, _ []parser.Node) error {
 		switch x := n.(type) {
 		case *parser.VectorSelector:
-			p.set[x.Name] = struct{}{}
+			names = append(names, x.Name)
 		case *parser.MatrixSelector:
 			if vs, ok := x.VectorSelector.(*parser.VectorSelector); ok {
-				p.set[vs.Name] = struct{}{}
+				names = append(names, vs.Name)
 			}
 		}
 		return nil
 	})
+	return names
 }
 
 func readFileContent(path string) ([]byte, error) {
@@ -123,13 +435,16 @@ func readFileContent(path string) ([]byte, error) {
 	return content, nil
 }
 
-func readFromVersion(version string) ([]byte, error) {
-	url := fmt.Sprintf("https://raw.githubusercontent.com/risingwavelabs/risingwave/refs/tags/%s/grafana/risingwave-dev-dashboard.json", version)
-	return readFromURL(url)
+func readFromURL(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	return readRequest(req)
 }
 
-func readFromURL(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func readRequest(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to fetch grafana dashboard from URL")
 	}
@@ -1,16 +1,261 @@
 package promdump
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/stretchr/testify/require"
 )
 
 func TestGrafanaDashboardParser(t *testing.T) {
 	p := NewGrafanaDashboardParser()
-	metrics, err := p.Parse("v2.6.2")
+	result, err := p.Parse("v2.6.2")
 	require.NoError(t, err)
 
-	fmt.Println(len(metrics))
+	fmt.Println(len(result.Metrics))
+}
+
+func TestTemplateResolver(t *testing.T) {
+	var templating Templating
+	require.NoError(t, json.Unmarshal([]byte(`{"list": [
+		{"name": "job", "type": "query", "query": {"query": "label_values(up, job)"}},
+		{"name": "quantile", "type": "custom", "query": "0.5,0.99", "options": [{"value": "0.5"}, {"value": "0.99"}]},
+		{"name": "prefix", "type": "constant", "query": "risingwave"},
+		{"name": "window", "type": "interval", "current": {"value": "10m"}},
+		{"name": "metric", "type": "query", "query": "metrics(stream_$prefix.*)"},
+		{"name": "groupby", "type": "custom", "query": "instance,job"},
+		{"name": "label", "type": "query", "query": "label_names(x)"},
+		{"name": "le", "type": "custom", "query": "0.5"}
+	]}`), &templating))
+	r := newTemplateResolver(&templating)
+
+	tests := []struct {
+		query    string
+		want     string
+		patterns []string
+	}{
+		{`rate(x{job=~"$job"}[$__rate_interval])`, `rate(x{job=~".+"}[5m])`, nil},
+		{`rate(x{job=~"${job:regex}"}[[[window]]])`, `rate(x{job=~".+"}[10m])`, nil},
+		{`histogram_quantile($quantile, sum(rate(x_bucket[$window])) by (le))`, `histogram_quantile(1, sum(rate(x_bucket[10m])) by (le))`, nil},
+		{`x{quantile=~"$quantile"}`, `x{quantile=~"0\\.5|0\\.99"}`, nil},
+		{`${prefix}_compute_total`, `risingwave_compute_total`, nil},
+		{`rate(${metric}[$window] offset $window)`, `rate(__promdump_metric__[10m] offset 10m)`, []string{"stream_risingwave.*"}},
+		{`topk($k, x)`, `topk(1, x)`, nil},
+		{`label_replace(x, "a", "$1", "b", "(.*)")`, `label_replace(x, "a", ".+", "b", "(.*)")`, nil},
+		{`x{le=~"$le"}`, `x{le=~"0\\.5"}`, nil},
+		{`x{le!~'$le'}`, `x{le!~'0\\.5'}`, nil},
+		{`x{le="$le"}`, `x{le="0.5"}`, nil},
+		{`sum by ($groupby) (x)`, `sum by (instance, job) (x)`, nil},
+		{`sum(x) BY (le, $groupby)`, `sum(x) BY (le, instance, job)`, nil},
+		{`sum without ($label) (x)`, `sum without (__promdump_label__) (x)`, nil},
+		{`x * on ($label) y`, `x * on (__promdump_label__) y`, nil},
+		{`x / ignoring(le,$label) y`, `x / ignoring(le,__promdump_label__) y`, nil},
+		{`x * on (job) group_left ($label) y`, `x * on (job) group_left (__promdump_label__) y`, nil},
+	}
+	for _, tt := range tests {
+		got, patterns, err := r.resolve(tt.query)
+		require.NoError(t, err, tt.query)
+		require.Equal(t, tt.want, got, tt.query)
+		require.Equal(t, tt.patterns, patterns, tt.query)
+		_, err = parser.ParseExpr(got)
+		require.NoError(t, err, got)
+	}
+
+	// only `metrics(regex)` variables can be resolved in a metric name
+	for _, query := range []string{`${job}_total`, `sum(rate($job[5m]))`, `${metric}_total`} {
+		_, _, err := r.resolve(query)
+		require.Error(t, err, query)
+	}
+}
+
+func TestGrafanaDashboardParserVariablesAndAnnotations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dashboard.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"panels": [{"targets": [
+			{"expr": "sum(rate(${metric}[$__rate_interval]))"},
+			{"expr": "sum(rate(${job}_total[$__rate_interval]))"}
+		]}],
+		"templating": {"list": [
+			{"name": "cluster", "type": "query", "query": "label_values(meta_num_of_cluster, risingwave_cluster)"},
+			{"name": "job", "type": "query", "query": {"query": "label_values(up{risingwave_cluster=\"$cluster\"}, job)"}},
+			{"name": "instance", "type": "query", "query": "label_values(instance)"},
+			{"name": "node", "type": "query", "query": "query_result(topk(5, node_load1))"},
+			{"name": "labels", "type": "query", "query": "label_names(process_cpu_seconds_total)"},
+			{"name": "metric", "type": "query", "query": "metrics(stream_.*)"}
+		]},
+		"annotations": {"list": [
+			{"expr": "changes(process_start_time_seconds[5m]) > 0"},
+			{"target": {"expr": "ALERTS"}}
+		]}
+	}`), 0644))
+
+	p := NewGrafanaDashboardParser()
+	result, err := p.Parse(path)
+	require.NoError(t, err)
+	require.Len(t, result.Failures, 1)
+	require.Equal(t, "sum(rate(${job}_total[$__rate_interval]))", result.Failures[0].Expr)
+	require.ElementsMatch(t, []string{
+		"meta_num_of_cluster",
+		"up",
+		"node_load1",
+		"process_cpu_seconds_total",
+		"process_start_time_seconds",
+		"ALERTS",
+	}, result.Metrics)
+	require.Equal(t, []string{"stream_.*"}, result.Patterns)
+}
+
+func TestGrafanaDashboardParserFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dashboard.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"panels": [
+			{"id": 1, "title": "ok", "targets": [{"expr": "up"}]},
+			{"id": 2, "title": "row", "panels": [
+				{"id": 3, "title": "broken", "targets": [{"expr": "sum(rate(x[5m])"}, {"expr": "process_start_time_seconds"}]}
+			]}
+		],
+		"annotations": {"list": [{"name": "bad", "expr": "{}"}]}
+	}`), 0644))
+
+	p := NewGrafanaDashboardParser()
+	result, err := p.Parse(path)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"up", "process_start_time_seconds"}, result.Metrics)
+	require.Len(t, result.Failures, 2)
+	require.Equal(t, "panel", result.Failures[0].Source)
+	require.Equal(t, 3, result.Failures[0].PanelID)
+	require.Equal(t, "broken", result.Failures[0].PanelTitle)
+	require.Equal(t, "sum(rate(x[5m])", result.Failures[0].Expr)
+	require.Equal(t, "annotation", result.Failures[1].Source)
+	require.Equal(t, "bad", result.Failures[1].Name)
+
+	p = NewGrafanaDashboardParser()
+	p.Strict = true
+	_, err = p.Parse(path)
+	require.ErrorContains(t, err, `panel 3 "broken"`)
+}
+
+func TestGrafanaDashboardParserLineage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dashboard.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"title": "dev",
+		"panels": [
+			{"id": 1, "type": "row", "title": "Streaming", "collapsed": true, "panels": [
+				{"id": 2, "title": "Throughput", "targets": [{"expr": "rate(up[5m])"}]}
+			]},
+			{"id": 3, "type": "row", "title": "Hummock"},
+			{"id": 4, "title": "Size", "targets": [{"expr": "hummock_size + up"}]}
+		]
+	}`), 0644))
+
+	result, err := NewGrafanaDashboardParser().Parse(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hummock_size", "up"}, result.Metrics)
+	require.Equal(t, []MetricLineage{
+		{Metric: "hummock_size", Usages: []Usage{
+			{Dashboard: "dev", Source: "panel", Row: "Hummock", PanelID: 4, PanelTitle: "Size", Expr: "hummock_size + up"},
+		}},
+		{Metric: "up", Usages: []Usage{
+			{Dashboard: "dev", Source: "panel", Row: "Streaming", PanelID: 2, PanelTitle: "Throughput", Expr: "rate(up[5m])"},
+			{Dashboard: "dev", Source: "panel", Row: "Hummock", PanelID: 4, PanelTitle: "Size", Expr: "hummock_size + up"},
+		}},
+	}, result.Lineage)
+}
+
+func TestGrafanaDashboardParserFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dashboard.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"panels": [
+			{"id": 10, "title": "Overview", "targets": [{"expr": "up"}]},
+			{"id": 1, "type": "row", "title": "Streaming", "collapsed": true, "panels": [
+				{"id": 2, "title": "Throughput", "targets": [{"expr": "stream_rows"}]},
+				{"id": 5, "title": "Barrier", "targets": [{"expr": "stream_barrier"}]}
+			]},
+			{"id": 3, "type": "row", "title": "Hummock"},
+			{"id": 4, "title": "Size", "targets": [{"expr": "hummock_size"}]}
+		],
+		"templating": {"list": [{"name": "job", "type": "query", "query": "label_values(meta_num_of_cluster, job)"}]}
+	}`), 0644))
+
+	filters := func(ss ...string) []*PanelFilter {
+		var ret []*PanelFilter
+		for _, s := range ss {
+			f, err := NewPanelFilter(s)
+			require.NoError(t, err)
+			ret = append(ret, f)
+		}
+		return ret
+	}
+	tests := []struct {
+		name   string
+		rows   []string
+		panels []string
+		want   []string
+	}{
+		{name: "collapsed row by title", rows: []string{"Stream.*"}, want: []string{"meta_num_of_cluster", "stream_barrier", "stream_rows"}},
+		{name: "expanded row by id", rows: []string{"3"}, want: []string{"hummock_size", "meta_num_of_cluster"}},
+		{name: "panel in row", rows: []string{"Streaming"}, panels: []string{"Barrier"}, want: []string{"meta_num_of_cluster", "stream_barrier"}},
+		{name: "panel by id", panels: []string{"10", "4"}, want: []string{"hummock_size", "meta_num_of_cluster", "up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewGrafanaDashboardParser()
+			p.RowFilters, p.PanelFilters = filters(tt.rows...), filters(tt.panels...)
+			result, err := p.Parse(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, result.Metrics)
+		})
+	}
+}
+
+func TestGrafanaDashboardParserGrafanaAPI(t *testing.T) {
+	dashboards := map[string]string{
+		"a": `{"dashboard": {"title": "A", "panels": [{"id": 1, "targets": [{"expr": "up"}]}]}, "meta": {"slug": "a"}}`,
+		"b": `{"dashboard": {"title": "B", "panels": [{"id": 1, "targets": [{"expr": "hummock_size"}]}]}, "meta": {"slug": "b"}}`,
+	}
+	var searches []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/grafana/api/search":
+			searches = append(searches, r.URL.Query())
+			fmt.Fprint(w, `[{"uid": "a"}, {"uid": "b"}]`)
+		case strings.HasPrefix(r.URL.Path, "/grafana/api/dashboards/uid/"):
+			fmt.Fprint(w, dashboards[strings.TrimPrefix(r.URL.Path, "/grafana/api/dashboards/uid/")])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	p := NewGrafanaDashboardParser()
+	p.GrafanaToken = "secret"
+	result, err := p.Parse("grafana+http://" + host + "/grafana/uid/a")
+	require.NoError(t, err)
+	require.Equal(t, []string{"up"}, result.Metrics)
+	require.Equal(t, "A", result.Lineage[0].Usages[0].Dashboard)
+
+	p = NewGrafanaDashboardParser()
+	p.GrafanaToken = "secret"
+	result, err = p.Parse("grafana+http://" + host + "/grafana/search?tag=risingwave")
+	require.NoError(t, err)
+	require.Equal(t, []string{"hummock_size", "up"}, result.Metrics)
+	require.Len(t, searches, 1)
+	require.Equal(t, "risingwave", searches[0].Get("tag"))
+	require.Equal(t, "dash-db", searches[0].Get("type"))
+
+	_, err = NewGrafanaDashboardParser().Parse("grafana+http://" + host + "/grafana/uid/a")
+	require.ErrorContains(t, err, "status code 401")
 }
@@ -0,0 +1,444 @@
+package promdump
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+// Variable is a dashboard templating variable.
+type Variable struct {
+	Name string `json:"name"`
+	// Type is one of query, custom, constant, interval, textbox, datasource, adhoc
+	Type string `json:"type"`
+	// Query is either a string or an object with a `query` field, depending
+	// on the type of the variable and the Grafana version
+	Query   json.RawMessage `json:"query"`
+	Current struct {
+		Value json.RawMessage `json:"value"`
+	} `json:"current"`
+	Options []struct {
+		Value json.RawMessage `json:"value"`
+	} `json:"options"`
+}
+
+// QueryString returns the query of the variable as a string.
+func (v *Variable) QueryString() string {
+	if len(v.Query) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(v.Query, &s); err == nil {
+		return s
+	}
+	var obj struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(v.Query, &obj); err == nil {
+		return obj.Query
+	}
+	return ""
+}
+
+// values returns the literal values of custom, constant and textbox
+// variables, or nil if the values are only known at query time.
+func (v *Variable) values() []string {
+	switch v.Type {
+	case "constant", "textbox":
+		if q := v.QueryString(); q != "" {
+			return []string{q}
+		}
+		return decodeValues(v.Current.Value)
+	case "custom":
+		var ret []string
+		for _, opt := range v.Options {
+			for _, val := range decodeValues(opt.Value) {
+				if val != "$__all" {
+					ret = append(ret, val)
+				}
+			}
+		}
+		if len(ret) > 0 {
+			return ret
+		}
+		// options are not always saved, fall back to the query `a,b` or `text : a,text : b`
+		for _, item := range strings.Split(v.QueryString(), ",") {
+			if _, val, ok := strings.Cut(item, " : "); ok {
+				item = val
+			}
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+// decodeValues decodes a value that is either a string or a list of strings.
+func decodeValues(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}
+	}
+	var l []string
+	if err := json.Unmarshal(raw, &l); err == nil {
+		return l
+	}
+	return nil
+}
+
+// variableRegex matches $var, ${var}, ${var:format}, ${var.field}, [[var]] and [[var:format]]
+var variableRegex = regexp.MustCompile(`\$(\w+)|\[\[(\w+?)(?::(\w+))?\]\]|\$\{(\w+)(?:\.[^:}]+)?(?::([^}]+))?\}`)
+
+const (
+	placeholderDuration = "5m"
+	placeholderRegex    = ".+"
+	placeholderNumber   = "1"
+	placeholderLabel    = "__promdump_label__"
+	// placeholderMetric replaces a `metrics(regex)` variable used as a
+	// metric name, the regex is reported as a pattern instead
+	placeholderMetric = "__promdump_metric__"
+)
+
+// builtinVariables are the global variables of Grafana
+var builtinVariables = map[string]string{
+	"__interval":      placeholderDuration,
+	"__rate_interval": placeholderDuration,
+	"__range":         placeholderDuration,
+	"__interval_ms":   "300000",
+	"__range_ms":      "300000",
+	"__range_s":       "300",
+	"__from":          "0",
+	"__to":            "0",
+}
+
+// templateResolver substitutes dashboard variables in PromQL expressions with
+// placeholders of the right type, so that the expressions can be parsed.
+type templateResolver struct {
+	variables map[string]*Variable
+}
+
+func newTemplateResolver(templating *Templating) *templateResolver {
+	r := &templateResolver{
+		variables: make(map[string]*Variable),
+	}
+	if templating != nil {
+		for i := range templating.List {
+			r.variables[templating.List[i].Name] = &templating.List[i]
+		}
+	}
+	return r
+}
+
+// resolve substitutes all variables in the query. The placeholder depends on
+// where the variable is used:
+//   - in a string literal, e.g. a label matcher: the literal values of custom
+//     and constant variables joined as a regex, escaped if the literal is the
+//     value of a regex matcher, or `.+` otherwise
+//   - in brackets, e.g. a range vector or subquery: the interval value, or a
+//     default duration
+//   - in the label list of a grouping or vector matching, e.g. `by ($label)`:
+//     the literal values, or a label name
+//   - elsewhere: the literal value, a duration after `offset`, or a number,
+//     e.g. for function arguments
+//
+// A variable used as a whole metric name is only known for `metrics(regex)`
+// variables, their regexes are returned as patterns. Any other variable in a
+// metric name, or a fragment of it, is an error.
+func (r *templateResolver) resolve(query string) (string, []string, error) {
+	var (
+		b        strings.Builder
+		quote    rune // the quote of the string literal the scanner is in, 0 if not in a string
+		literal  int  // the start of the string literal the scanner is in
+		escaped  bool
+		brackets int
+		last     int
+		patterns []string
+	)
+	scan := func(offset int, s string) {
+		for i, c := range s {
+			switch {
+			case quote != 0:
+				if escaped {
+					escaped = false
+				} else if c == '\\' && quote != '`' {
+					escaped = true
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'' || c == '`':
+				quote = c
+				literal = offset + i
+			case c == '[':
+				brackets++
+			case c == ']':
+				brackets--
+			}
+		}
+	}
+
+	for _, m := range variableRegex.FindAllStringSubmatchIndex(query, -1) {
+		start, end := m[0], m[1]
+		scan(last, query[last:start])
+		b.WriteString(query[last:start])
+		last = end
+
+		name := ""
+		for _, i := range []int{2, 4, 8} {
+			if m[i] >= 0 {
+				name = query[m[i]:m[i+1]]
+				break
+			}
+		}
+
+		switch {
+		case quote != 0:
+			b.WriteString(r.stringPlaceholder(name, quote, isRegexMatcher(query[:literal])))
+		case brackets > 0:
+			b.WriteString(r.durationPlaceholder(name))
+		default:
+			placeholder, pattern, err := r.barePlaceholder(name, query[:start], query[end:])
+			if err != nil {
+				return "", nil, err
+			}
+			if pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+			b.WriteString(placeholder)
+		}
+	}
+	b.WriteString(query[last:])
+	return b.String(), patterns, nil
+}
+
+// resolveRegex substitutes all variables in the regex of a `metrics(regex)`
+// query, the regex may be quoted.
+func (r *templateResolver) resolveRegex(regex string) string {
+	regex = strings.Trim(regex, "\"'`")
+	return variableRegex.ReplaceAllStringFunc(regex, func(s string) string {
+		m := variableRegex.FindStringSubmatch(s)
+		for _, name := range []string{m[1], m[2], m[4]} {
+			if name != "" {
+				return r.stringPlaceholder(name, '`', true)
+			}
+		}
+		return s
+	})
+}
+
+// stringPlaceholder returns the placeholder of a variable in a string literal,
+// the values are escaped as a regex if regex is set.
+func (r *templateResolver) stringPlaceholder(name string, quote rune, regex bool) string {
+	if v, ok := builtinVariables[name]; ok {
+		return v
+	}
+	variable, ok := r.variables[name]
+	if !ok {
+		return placeholderRegex
+	}
+	values := variable.values()
+	switch {
+	case variable.Type == "interval":
+		return r.durationPlaceholder(name)
+	case len(values) == 0:
+		return placeholderRegex
+	default:
+		escapedValues := make([]string, len(values))
+		for i, val := range values {
+			if regex {
+				val = regexp.QuoteMeta(val)
+			}
+			escapedValues[i] = escapeString(val, quote)
+		}
+		return strings.Join(escapedValues, "|")
+	}
+}
+
+// regexMatcherRegex matches the text before the value of a regex matcher
+var regexMatcherRegex = regexp.MustCompile(`[=!]~\s*$`)
+
+// isRegexMatcher returns whether a string literal after the text before is
+// the value of a regex matcher.
+func isRegexMatcher(before string) bool {
+	return regexMatcherRegex.MatchString(before)
+}
+
+func (r *templateResolver) durationPlaceholder(name string) string {
+	if v, ok := builtinVariables[name]; ok {
+		return v
+	}
+	variable, ok := r.variables[name]
+	if !ok {
+		return placeholderDuration
+	}
+	candidates := decodeValues(variable.Current.Value)
+	if variable.Type != "interval" {
+		candidates = append(variable.values(), candidates...)
+	}
+	for _, c := range candidates {
+		if isDuration(c) {
+			return c
+		}
+	}
+	return placeholderDuration
+}
+
+// barePlaceholder returns the placeholder of a variable outside of string
+// literals and brackets, and the regex of a `metrics(regex)` variable used as
+// a metric name.
+func (r *templateResolver) barePlaceholder(name, before, after string) (string, string, error) {
+	if v, ok := builtinVariables[name]; ok {
+		return v, "", nil
+	}
+	variable, ok := r.variables[name]
+	if ok {
+		if variable.Type == "interval" {
+			return r.durationPlaceholder(name), "", nil
+		}
+		if values := variable.values(); len(values) == 1 {
+			return values[0], "", nil
+		}
+	}
+	trimmedBefore := strings.TrimRight(before, " \t\n")
+	trimmedAfter := strings.TrimLeft(after, " \t\n")
+	switch {
+	case strings.HasSuffix(trimmedBefore, "offset"):
+		return r.durationPlaceholder(name), "", nil
+	case labelListRegex.MatchString(before):
+		return r.labelPlaceholder(name), "", nil
+	case endsWithIdentifier(before) || startsWithIdentifier(after):
+		return "", "", errors.Errorf("variable %q is used in a metric name", name)
+	case strings.HasPrefix(trimmedAfter, "{") || strings.HasPrefix(trimmedAfter, "["):
+		// a whole metric name
+		if ok && variable.Type == "query" {
+			if _, pattern := parseVariableQuery(variable.QueryString()); pattern != "" {
+				return placeholderMetric, r.resolveRegex(pattern), nil
+			}
+		}
+		return "", "", errors.Errorf("variable %q is used as a metric name", name)
+	default:
+		return placeholderNumber, "", nil
+	}
+}
+
+// labelListRegex matches the text before a label in the label list of a
+// grouping, e.g. `sum by (`, or of a vector matching, e.g. `on (a, `
+var labelListRegex = regexp.MustCompile(`(?i)(?:^|[^\w:])(?:by|without|on|ignoring|group_left|group_right)\s*\((?:[^(),"'` + "`" + `]*,)*\s*$`)
+
+// labelNameRegex matches a valid label name
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelPlaceholder returns the placeholder of a variable in a label list: the
+// values joined as a list if they are all label names, or a label name.
+func (r *templateResolver) labelPlaceholder(name string) string {
+	variable, ok := r.variables[name]
+	if !ok {
+		return placeholderLabel
+	}
+	values := variable.values()
+	if len(values) == 0 {
+		return placeholderLabel
+	}
+	for _, val := range values {
+		if !labelNameRegex.MatchString(val) {
+			return placeholderLabel
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func endsWithIdentifier(s string) bool {
+	return len(s) > 0 && isIdentifierChar(s[len(s)-1])
+}
+
+func startsWithIdentifier(s string) bool {
+	return len(s) > 0 && isIdentifierChar(s[0])
+}
+
+var durationRegex = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|y))+$`)
+
+func isDuration(s string) bool {
+	return durationRegex.MatchString(s)
+}
+
+// escapeString escapes the value to be used in a string literal with the given quote
+func escapeString(s string, quote rune) string {
+	if quote == '`' {
+		return strings.ReplaceAll(s, "`", "")
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, string(quote), `\`+string(quote))
+}
+
+var variableQueryRegex = regexp.MustCompile(`(?s)^\s*(label_values|query_result|metrics|label_names)\s*\((.*)\)\s*$`)
+
+// parseVariableQuery returns the PromQL expressions referenced by the query
+// of a query variable, and the regex of `metrics(regex)`, which can only be
+// matched against the metric names of an endpoint.
+func parseVariableQuery(query string) (exprs []string, pattern string) {
+	m := variableQueryRegex.FindStringSubmatch(query)
+	if m == nil {
+		return nil, ""
+	}
+	args := strings.TrimSpace(m[2])
+	switch m[1] {
+	case "label_values":
+		// label_values(label) or label_values(selector, label)
+		if parts := splitTopLevel(args); len(parts) == 2 {
+			return []string{parts[0]}, ""
+		}
+	case "query_result":
+		return []string{args}, ""
+	case "label_names":
+		// label_names() or label_names(selector)
+		if args != "" {
+			return []string{args}, ""
+		}
+	case "metrics":
+		return nil, args
+	}
+	return nil, ""
+}
+
+// splitTopLevel splits the function arguments by the commas that are not
+// nested in brackets or string literals.
+func splitTopLevel(args string) []string {
+	var (
+		parts []string
+		depth int
+		quote rune
+		start int
+	)
+	for i, c := range args {
+		switch {
+		case quote != 0:
+			if c == quote && (i == 0 || args[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '{' || c == '[':
+			depth++
+		case c == ')' || c == '}' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(args[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(args[start:]))
+}
@@ -0,0 +1,48 @@
+package promdump
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataFileName is the name of the metadata file in the output directory of a dump.
+const MetadataFileName = "promdump-metadata.json"
+
+// Metadata describes a dump, so that the replay side can use the same dashboards.
+type Metadata struct {
+	// RisingWaveVersion is the version detected with `--grafana-dashboard auto`
+	RisingWaveVersion string `json:"risingwave_version,omitempty"`
+	// Dashboards are the dashboards the metrics names are retrieved from
+	Dashboards []string `json:"dashboards,omitempty"`
+}
+
+func writeMetadata(dir string, metadata *Metadata) error {
+	raw, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal metadata")
+	}
+	if err := os.WriteFile(filepath.Join(dir, MetadataFileName), raw, 0644); err != nil {
+		return errors.Wrap(err, "failed to write metadata")
+	}
+	return nil
+}
+
+// ReadMetadata reads the metadata file of the dump in dir, it returns nil if
+// there is none.
+func ReadMetadata(dir string) (*Metadata, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, MetadataFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read metadata")
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal metadata")
+	}
+	return &metadata, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 type DumpMultipartCfg struct {
@@ -20,6 +22,8 @@ type DumpMultipartCfg struct {
 	Parts     int
 	OutputDir string
 	Verbose   bool
+	// Metadata is written to the output directory if set, see MetadataFileName
+	Metadata *Metadata
 }
 
 func validateDumpOptions(cfg *DumpMultipartCfg) error {
@@ -33,7 +37,46 @@ func validateDumpOptions(cfg *DumpMultipartCfg) error {
 	if opt.Step <= 0 {
 		return errors.New("step must be greater than 0")
 	}
-	if opt.Endpoint == "" {
+	if opt.BatchMaxSeries < 0 {
+		return errors.New("batch max series must not be negative")
+	}
+	if opt.ShardMaxSeries < 0 {
+		return errors.New("shard max series must not be negative")
+	}
+	if c := opt.Capabilities; c != nil && c.MaxPoints <= 0 {
+		return errors.New("max points must be greater than 0")
+	}
+	if c := opt.Capabilities; c != nil && !c.ArbitrarySelectors && opt.Query != "" {
+		return errors.Errorf("query is not supported by %s, please use --grafana-dashboard", c.Backend)
+	}
+	switch opt.Source {
+	case "", SourceQueryRange:
+	case SourceVMExport:
+		if opt.Query != "" {
+			if _, err := parser.ParseMetricSelector(opt.Query); err != nil {
+				return errors.Errorf("query must be a series selector with source %s", opt.Source)
+			}
+		}
+	default:
+		return errors.Errorf("unknown source %s", opt.Source)
+	}
+	if opt.Selector != "" && opt.Query != "" {
+		return errors.New("selector can't be used with query")
+	}
+	if _, err := selectorMatchers(opt.Selector); err != nil {
+		return err
+	}
+	if opt.Source == SourceVMExport && (len(opt.Endpoints) > 1 || opt.SourceLabel != "") {
+		return errors.Errorf("source %s can't be used with multiple endpoints or a source label", opt.Source)
+	}
+	if opt.GrafanaURL != "" {
+		if opt.DatasourceUID == "" {
+			return errors.New("datasource uid must be provided with grafana url")
+		}
+		if len(opt.Endpoints) > 0 {
+			return errors.New("endpoints can't be used with grafana url")
+		}
+	} else if opt.Endpoint == "" && len(opt.Endpoints) == 0 {
 		return errors.New("endpoint must be provided")
 	}
 	return nil
@@ -49,10 +92,17 @@ func getOutputDir(cfg *DumpMultipartCfg) (string, error) {
 		if err != nil {
 			return "", errors.Wrap(err, "failed to get current directory")
 		}
-		// digest
-		digest := sha256.New()
-		digest.Write([]byte(fmt.Sprintf("%+v", opt)))
-		digestStr := hex.EncodeToString(digest.Sum(nil))[:8]
+		// digest of the options, so that a rerun resumes in the same directory.
+		// JSON dereferences the pointers and drops the monotonic clock reading
+		// of the times, and the token may be rotated between runs
+		key := *opt
+		key.GrafanaToken = ""
+		content, err := json.Marshal(&key)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to marshal dump options")
+		}
+		digest := sha256.Sum256(content)
+		digestStr := hex.EncodeToString(digest[:])[:8]
 		return filepath.Join(wd, fmt.Sprintf("promdump_%s", digestStr)), nil
 	} else { // user specified output directory
 		if !filepath.IsAbs(cfg.OutputDir) {
@@ -77,7 +127,11 @@ func DumpMultipart(ctx context.Context, cfg *DumpMultipartCfg, cb DumpProgressCa
 		}
 	}
 
-	v("Dumping Prometheus data from %s to %s\n", opt.Endpoint, cfg.OutputDir)
+	from := opt.address()
+	if len(opt.Endpoints) > 0 {
+		from = strings.Join(opt.Endpoints, ", ")
+	}
+	v("Dumping Prometheus data from %s to %s\n", from, cfg.OutputDir)
 	v("Time range: %s to %s with step %s\n", opt.Start.Format(time.RFC3339), opt.End.Format(time.RFC3339), opt.Step)
 
 	if err := validateDumpOptions(cfg); err != nil {
@@ -89,6 +143,15 @@ func DumpMultipart(ctx context.Context, cfg *DumpMultipartCfg, cb DumpProgressCa
 		return errors.Wrap(err, "failed to get output directory")
 	}
 
+	if cfg.Metadata != nil {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return errors.Wrap(err, "failed to create output directory")
+		}
+		if err := writeMetadata(outDir, cfg.Metadata); err != nil {
+			return err
+		}
+	}
+
 	if cfg.Parts == 1 { // output to a file
 		if err := os.MkdirAll(outDir, 0755); err != nil {
 			return errors.Wrap(err, "failed to create output directory")
@@ -140,14 +203,17 @@ func DumpMultipart(ctx context.Context, cfg *DumpMultipartCfg, cb DumpProgressCa
 			}
 		}
 
-		// split the start and end time into parts
+		// split the start and end time into parts. Both bounds of the queries
+		// are inclusive, so the inner parts end a millisecond before the next
+		// one starts, and the last part ends at the end
 		var timeRanges [][]time.Time
 		rangeInterval := opt.End.Sub(opt.Start) / time.Duration(cfg.Parts)
 		for i := 0; i < cfg.Parts; i++ {
-			timeRanges = append(timeRanges, []time.Time{
-				opt.Start.Add(time.Duration(i) * rangeInterval),
-				opt.Start.Add(time.Duration(i+1) * rangeInterval),
-			})
+			end := opt.End
+			if i < cfg.Parts-1 {
+				end = opt.Start.Add(time.Duration(i+1) * rangeInterval).Add(-time.Millisecond)
+			}
+			timeRanges = append(timeRanges, []time.Time{opt.Start.Add(time.Duration(i) * rangeInterval), end})
 		}
 
 		for i, timeRange := range timeRanges {
@@ -160,8 +226,11 @@ func DumpMultipart(ctx context.Context, cfg *DumpMultipartCfg, cb DumpProgressCa
 				outFile += ".gz"
 			}
 
-			// Execute the dump
-			err = DumpToFileWithCallback(ctx, opt, outFile, func(query string, value model.Matrix, progress float32) error {
+			// Execute the dump of the time range of the part, the parts must
+			// not dump the whole time range each
+			partOpt := *opt
+			partOpt.Start, partOpt.End = timeRange[0], timeRange[1]
+			err = DumpToFileWithCallback(ctx, &partOpt, outFile, func(query string, value model.Matrix, progress float32) error {
 				if cb != nil {
 					return cb(i+1, cfg.Parts, progress)
 				}
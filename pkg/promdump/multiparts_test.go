@@ -0,0 +1,92 @@
+package promdump
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpMultipartTimeRanges(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{"/api/v1/query_range": matrixHandler("")})
+
+	dir := t.TempDir()
+	err := DumpMultipart(context.Background(), &DumpMultipartCfg{
+		Opt: &DumpOpt{
+			Endpoint:     srv.URL,
+			Start:        time.Unix(0, 0),
+			End:          time.Unix(120, 0),
+			Step:         time.Second,
+			MetricsNames: []string{"up"},
+			MemoryRatio:  1,
+		},
+		Parts:     2,
+		OutputDir: dir,
+	}, nil)
+	require.NoError(t, err)
+	// every part only queries its own time range, not the whole one
+	var ranges [][2]string
+	for _, r := range srv.Requests("/api/v1/query_range") {
+		ranges = append(ranges, [2]string{r.Form.Get("start"), r.Form.Get("end")})
+	}
+	// the inner boundary belongs to the next part only
+	require.Equal(t, [][2]string{{"0", "59.999"}, {"60", "120"}}, ranges)
+	for _, part := range []string{"0.ndjson", "1.ndjson"} {
+		_, err := os.Stat(filepath.Join(dir, part))
+		require.NoError(t, err)
+	}
+}
+
+func TestDumpMultipartResumeTimeRanges(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{"/api/v1/query_range": matrixHandler("")})
+
+	// the last part written may be incomplete and is dumped again
+	dir := t.TempDir()
+	for _, part := range []string{"0.ndjson", "1.ndjson"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, part), nil, 0644))
+	}
+	err := DumpMultipart(context.Background(), &DumpMultipartCfg{
+		Opt: &DumpOpt{
+			Endpoint:     srv.URL,
+			Start:        time.Unix(0, 0),
+			End:          time.Unix(180, 0),
+			Step:         time.Second,
+			MetricsNames: []string{"up"},
+			MemoryRatio:  1,
+		},
+		Parts:     3,
+		OutputDir: dir,
+	}, nil)
+	require.NoError(t, err)
+	// the remaining parts only dump their own time ranges, not the whole one
+	require.Equal(t, []string{"60", "120"}, srv.Values("/api/v1/query_range", "start"))
+	require.Equal(t, []string{"119.999", "180"}, srv.Values("/api/v1/query_range", "end"))
+}
+
+func TestGetOutputDir(t *testing.T) {
+	t.Chdir(t.TempDir())
+	end := time.Now()
+	opt := func(dedup bool) *DumpOpt {
+		// new pointers for every run, as when the options are parsed again
+		return &DumpOpt{
+			Endpoint:     "http://localhost:9090",
+			Start:        time.Unix(0, 0),
+			End:          end,
+			Step:         time.Minute,
+			Dedup:        &dedup,
+			Capabilities: &Capabilities{Backend: BackendThanos, MaxPoints: 11000},
+		}
+	}
+	dir, err := getOutputDir(&DumpMultipartCfg{Opt: opt(true), OutputDir: "."})
+	require.NoError(t, err)
+	same, err := getOutputDir(&DumpMultipartCfg{Opt: opt(true), OutputDir: "."})
+	require.NoError(t, err)
+	require.Equal(t, dir, same)
+	other, err := getOutputDir(&DumpMultipartCfg{Opt: opt(false), OutputDir: "."})
+	require.NoError(t, err)
+	require.NotEqual(t, dir, other)
+}
@@ -0,0 +1,83 @@
+package promdump
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// planBatches groups the metrics into queries like {__name__=~"a|b|c"} of at
+// most maxSeries series, estimated with the series API for the time range.
+// The series of a metric are its most series on any of the endpoints, so that
+// the batches are within the budget on all of them. Metrics with more series
+// are queried alone, and metrics without series in the time range are not
+// queried.
+func planBatches(ctx context.Context, apis []v1.API, metrics []string, matchers []*labels.Matcher, maxSeries int, start, end time.Time) ([]string, error) {
+	maxCounts := make(map[string]int)
+	for _, v1api := range apis {
+		endpointCounts, err := countSeries(ctx, v1api, metrics, matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for metric, n := range endpointCounts {
+			maxCounts[metric] = max(maxCounts[metric], n)
+		}
+	}
+	counts := metricCoverages(metrics, maxCounts)
+
+	var (
+		queries     []string
+		batch       []string
+		batchSeries int
+		empty       int
+	)
+	flush := func() error {
+		switch len(batch) {
+		case 0:
+			return nil
+		case 1:
+			queries = append(queries, metricQuery(batch[0], matchers))
+		default:
+			selector, err := namesSelector(batch, matchers)
+			if err != nil {
+				return err
+			}
+			queries = append(queries, selector)
+		}
+		batch, batchSeries = nil, 0
+		return nil
+	}
+	for _, c := range counts {
+		if c.Series == 0 {
+			empty++
+			continue
+		}
+		if c.Series >= maxSeries {
+			queries = append(queries, metricQuery(c.Metric, matchers))
+			continue
+		}
+		if batchSeries+c.Series > maxSeries {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		batch = append(batch, c.Metric)
+		batchSeries += c.Series
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Planned %d queries for %d metrics, %d metrics have no series in the time range\n", len(queries), len(metrics), empty)
+	return queries, nil
+}
+
+// metricQuery returns the query of the metric, with the matchers if any.
+func metricQuery(metric string, matchers []*labels.Matcher) string {
+	if len(matchers) == 0 {
+		return metric
+	}
+	return withMatchers(metric, matchers)
+}
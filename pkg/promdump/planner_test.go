@@ -0,0 +1,40 @@
+package promdump
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanBatches(t *testing.T) {
+	var series []labels.Labels
+	for metric, n := range map[string]int{"a": 2, "b": 3, "c": 1, "big": 10, "d": 4} {
+		for i := 0; i < n; i++ {
+			series = append(series, labels.FromStrings("__name__", metric, "job", "rw", "i", fmt.Sprint(i)))
+		}
+	}
+	srv := newFakeProm(t, map[string]http.HandlerFunc{"/api/v1/series": seriesHandler(series)})
+
+	client, err := newAPIClient(&DumpOpt{Endpoint: srv.URL})
+	require.NoError(t, err)
+	matchers, err := selectorMatchers(`{job="rw"}`)
+	require.NoError(t, err)
+	queries, err := planBatches(context.Background(), []v1.API{v1.NewAPI(client)}, []string{"a", "b", "big", "c", "d", "empty"}, matchers, 6, time.Unix(0, 0), time.Unix(60, 0))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`big{job="rw"}`,
+		`{__name__=~"a|b|c",job="rw"}`,
+		`d{job="rw"}`,
+	}, queries)
+	selectors := srv.Values("/api/v1/series", "match[]")
+	require.NotEmpty(t, selectors)
+	for _, selector := range selectors {
+		require.Contains(t, selector, `job="rw"`)
+	}
+}
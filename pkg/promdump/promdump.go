@@ -6,28 +6,67 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	prom_model "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 const PrometheusDefaultMaxResolution = 11_000
 
 type DumpOpt struct {
-	Endpoint     string
-	Start        time.Time
-	End          time.Time
-	Step         time.Duration
-	Query        string
+	Endpoint string
+	Start    time.Time
+	End      time.Time
+	Step     time.Duration
+	Query    string
+	// Selector is a series selector like {namespace="rw"}, its matchers are
+	// added to the query of every metric. It can't be used with Query.
+	Selector     string
 	MetricsNames []string
-	Gzip         bool
-	MemoryRatio  float32
+	// MetricsPatterns are regexes matched against all metric names of the endpoint,
+	// the matched names are dumped in addition to MetricsNames
+	MetricsPatterns []string
+	Gzip            bool
+	MemoryRatio     float32
+	// BatchMaxSeries enables querying several metrics at once, with at most
+	// this number of series per query. 0 queries every metric alone.
+	BatchMaxSeries int
+	// ShardMaxSeries splits the query of a metric with more series into one
+	// query per value of ShardLabel, or of its label with the most values if
+	// ShardLabel is empty. 0 only splits queries rejected as too large.
+	ShardMaxSeries int
+	ShardLabel     string
+	// GrafanaURL and DatasourceUID query the Prometheus datasource through the
+	// datasource proxy of Grafana instead of Endpoint
+	GrafanaURL    string
+	DatasourceUID string
+	// GrafanaToken is the service account token used with GrafanaURL
+	GrafanaToken string
+	// Endpoints are all queried instead of Endpoint if set, and the series with
+	// the same labels, e.g. of an HA pair, are merged
+	Endpoints []string
+	// SourceLabel is set to the endpoint of every series if not empty, the
+	// first endpoint that returned a merged series, see seriesMerger
+	SourceLabel string
+	// Tenant is sent as the X-Scope-OrgID header of Mimir, Cortex and Thanos
+	Tenant string
+	// Dedup, PartialResponse and MaxSourceResolution are the query parameters
+	// of Thanos, they are not sent if unset
+	Dedup               *bool
+	PartialResponse     *bool
+	MaxSourceResolution string
+	// Source of the samples, SourceQueryRange if empty
+	Source string
+	// Capabilities of the backend of the endpoint, see DetectBackend. The
+	// ones of Prometheus are used if nil.
+	Capabilities *Capabilities
 }
 
 func DumpToFileWithCallback(ctx context.Context, opt *DumpOpt, filename string, cb QueryCallback) error {
@@ -50,6 +89,13 @@ func DumpToWriter(ctx context.Context, opt *DumpOpt, writer io.Writer, cb QueryC
 		w = writer
 	}
 
+	if opt.Source == SourceVMExport {
+		if err := exportVM(ctx, opt, w, cb); err != nil {
+			return errors.Wrapf(err, "failed to export")
+		}
+		return nil
+	}
+
 	isFirstItem := true
 	if err := dump(ctx, opt, func(query string, value prom_model.Matrix, progress float32) error {
 		write := func(p []byte) error {
@@ -66,6 +112,8 @@ func DumpToWriter(ctx context.Context, opt *DumpOpt, writer io.Writer, cb QueryC
 		}
 
 		for i, series := range value {
+			// both float samples and native histogram samples are written,
+			// as `values` and `histograms` respectively
 			raw, err := json.Marshal(series)
 			if err != nil {
 				return errors.Wrapf(err, "failed to marshal value")
@@ -98,71 +146,250 @@ func DumpToWriter(ctx context.Context, opt *DumpOpt, writer io.Writer, cb QueryC
 type QueryCallback func(query string, value prom_model.Matrix, progress float32) error
 
 func dump(ctx context.Context, opt *DumpOpt, cb QueryCallback) error {
-	client, err := api.NewClient(api.Config{
-		Address: opt.Endpoint,
-		Client:  &http.Client{},
-	})
+	eopts := opt.endpointOpts()
+	apis := make([]v1.API, len(eopts))
+	for i, eopt := range eopts {
+		client, err := newAPIClient(eopt)
+		if err != nil {
+			return err
+		}
+		apis[i] = v1.NewAPI(client)
+	}
+	// the same queries run on all endpoints, e.g. of sharded Prometheus instances
+	queries, err := buildQueries(ctx, apis, opt)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create prometheus client")
+		return err
+	}
+
+	// calculate query chunks
+	timeRanges := calTimeRanges(opt.Start, opt.End, opt.Step, opt.capabilities().MaxPoints, opt.MemoryRatio)
+
+	// run all queries
+	for qi, query := range queries {
+		if len(eopts) > 1 {
+			if err := queryEndpoints(ctx, apis, eopts, query, timeRanges, func(matrix prom_model.Matrix, progress float32) error {
+				if cb == nil {
+					return nil
+				}
+				progress = (float32(qi) + progress) / float32(len(queries))
+				if err := cb(query, matrix, progress); err != nil {
+					return errors.Wrapf(err, "failed to run callback")
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// shards of a query are written to the same output as the query
+		err := queryWithSharding(ctx, apis[0], query, eopts[0], timeRanges, func(query string, matrix prom_model.Matrix, progress float32) error {
+			if cb == nil {
+				return nil
+			}
+			for _, s := range matrix {
+				s.Metric = tagSource(s.Metric, opt.SourceLabel, eopts[0].address())
+			}
+			progress = (float32(qi) + progress) / float32(len(queries))
+			if err := cb(query, matrix, progress); err != nil {
+				return errors.Wrapf(err, "failed to run callback")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	v1api := v1.NewAPI(client)
+// queryEndpoints runs the query on every endpoint and merges their series,
+// see seriesMerger. The endpoints are queried one time range after another,
+// so that only the series of a time range are kept in memory to be merged.
+func queryEndpoints(ctx context.Context, apis []v1.API, eopts []*DumpOpt, query string, timeRanges []TimeRange, cb func(matrix prom_model.Matrix, progress float32) error) error {
+	merger := newSeriesMerger(eopts[0].SourceLabel)
+	for ti, timeRange := range timeRanges {
+		for i, eopt := range eopts {
+			// the shards are planned for the time range as well
+			ropt := *eopt
+			ropt.Start, ropt.End = timeRange.Start, timeRange.End
+			err := queryWithSharding(ctx, apis[i], query, &ropt, []TimeRange{timeRange}, func(_ string, matrix prom_model.Matrix, _ float32) error {
+				merger.add(matrix, eopt.address())
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to query %s", eopt.Endpoint)
+			}
+		}
+		if err := cb(merger.flush(), float32(ti+1)/float32(len(timeRanges))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// construct queries
-	var queries []string
+// buildQueries returns the queries of opt: the query, or a selector per
+// metric, or per batch of metrics. The metrics are the union of the metrics
+// of all endpoints, and the batches are planned once for all of them, so that
+// every endpoint runs the same queries.
+func buildQueries(ctx context.Context, apis []v1.API, opt *DumpOpt) ([]string, error) {
 	if len(opt.Query) > 0 {
-		queries = []string{opt.Query}
-	} else if len(opt.MetricsNames) > 0 {
+		return []string{opt.Query}, nil
+	}
+	matchers, err := selectorMatchers(opt.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []string
+	seen := make(map[string]struct{})
+	for _, v1api := range apis {
+		endpointMetrics, err := listMetrics(ctx, v1api, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, metric := range endpointMetrics {
+			if _, ok := seen[metric]; !ok {
+				seen[metric] = struct{}{}
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+
+	if opt.BatchMaxSeries > 0 && !opt.capabilities().ArbitrarySelectors {
+		fmt.Printf("Warning: batching is disabled, %s doesn't allow selectors without a metric name\n", opt.capabilities().Backend)
+	} else if opt.BatchMaxSeries > 0 {
+		queries, err := planBatches(ctx, apis, metrics, matchers, opt.BatchMaxSeries, opt.Start, opt.End)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to plan batches")
+		}
+		return queries, nil
+	}
+	queries := make([]string, len(metrics))
+	for i, metric := range metrics {
+		queries[i] = metricQuery(metric, matchers)
+	}
+	return queries, nil
+}
+
+// listMetrics returns the metrics names of opt on the endpoint: the names and
+// the names matching the patterns, or all metrics names.
+func listMetrics(ctx context.Context, v1api v1.API, opt *DumpOpt) ([]string, error) {
+	var labelMatches []string
+	if opt.Selector != "" {
+		labelMatches = []string{opt.Selector}
+	}
+
+	var metrics []string
+	if len(opt.MetricsNames) > 0 || len(opt.MetricsPatterns) > 0 {
 		fmt.Printf("Fetching with %d metrics names\n", len(opt.MetricsNames))
+		seen := make(map[string]struct{})
 		for _, metric := range opt.MetricsNames {
 			metricName := strings.TrimSpace(metric)
 			if metricName == "" {
 				continue
 			}
-			queries = append(queries, metricName)
+			seen[metricName] = struct{}{}
+			metrics = append(metrics, metricName)
+		}
+		if len(opt.MetricsPatterns) > 0 {
+			matched, err := matchMetricsNames(ctx, v1api, opt.MetricsPatterns, labelMatches, opt.Start, opt.End)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to match metrics patterns")
+			}
+			for _, metricName := range matched {
+				if _, ok := seen[metricName]; !ok {
+					seen[metricName] = struct{}{}
+					metrics = append(metrics, metricName)
+				}
+			}
 		}
 	} else { // get all metric names
 		fmt.Println("Fetching all metric names from prometheus...")
-		labelValues, warnings, err := v1api.LabelValues(ctx, "__name__", []string{}, opt.Start, opt.End)
+		labelValues, warnings, err := v1api.LabelValues(ctx, "__name__", labelMatches, opt.Start, opt.End)
 		if err != nil {
-			return errors.Wrapf(err, "failed to get label values")
+			return nil, errors.Wrapf(err, "failed to get label values")
 		}
 		if len(warnings) > 0 {
-			return errors.Errorf("warnings: %v", warnings)
+			return nil, errors.Errorf("warnings: %v", warnings)
 		}
 		for _, labelValue := range labelValues {
-			queries = append(queries, string(labelValue))
+			metrics = append(metrics, string(labelValue))
 		}
 	}
+	return metrics, nil
+}
 
-	// calculate query chunks
-	timeRanges := calTimeRanges(opt.Start, opt.End, opt.Step, opt.MemoryRatio)
-
-	// run all queries
-	for qi, query := range queries {
-		vs, warnings, err := queryAndMerge(ctx, v1api, string(query), opt.Step, timeRanges)
+// matchMetricsNames returns the metric names of the endpoint matching any of the patterns
+func matchMetricsNames(ctx context.Context, v1api v1.API, patterns []string, matches []string, start, end time.Time) ([]string, error) {
+	var regexes []*regexp.Regexp
+	for _, pattern := range patterns {
+		// patterns are anchored like PromQL regex matchers
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
 		if err != nil {
-			return errors.Wrapf(err, "failed to query range")
+			return nil, errors.Wrapf(err, "invalid metrics pattern %s", pattern)
 		}
-		if len(warnings) > 0 {
-			return errors.Errorf("warnings: %v", warnings)
-		}
-		// traverse all matrices
-		for vi, v := range vs {
-			matrix, ok := v.(prom_model.Matrix)
-			if !ok {
-				return errors.New("value is not a matrix")
-			}
-			progress := float32(qi+1)/float32(len(queries)) +
-				float32(vi+1)/float32(len(vs))*(1/float32(len(queries)))
-			if cb != nil {
-				if err := cb(string(query), matrix, progress); err != nil {
-					return errors.Wrapf(err, "failed to run callback")
-				}
+		regexes = append(regexes, re)
+	}
+	labelValues, warnings, err := v1api.LabelValues(ctx, "__name__", matches, start, end)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get label values")
+	}
+	if len(warnings) > 0 {
+		return nil, errors.Errorf("warnings: %v", warnings)
+	}
+	var matched []string
+	for _, labelValue := range labelValues {
+		for _, re := range regexes {
+			if re.MatchString(string(labelValue)) {
+				matched = append(matched, string(labelValue))
+				break
 			}
 		}
 	}
-	return nil
+	return matched, nil
+}
+
+// selectorMatchers parses the matchers of the selector, which must not select
+// the metric name.
+func selectorMatchers(selector string) ([]*labels.Matcher, error) {
+	if selector == "" {
+		return nil, nil
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector %s", selector)
+	}
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			return nil, errors.Errorf("invalid selector %s, it must not match %s", selector, labels.MetricName)
+		}
+	}
+	return matchers, nil
+}
+
+// withMatchers returns the selector of the metric with the matchers, e.g.
+// up{namespace="rw"}.
+func withMatchers(metric string, matchers []*labels.Matcher) string {
+	strs := make([]string, len(matchers))
+	for i, m := range matchers {
+		strs[i] = m.String()
+	}
+	return metric + "{" + strings.Join(strs, ",") + "}"
+}
+
+// namesSelector returns the selector of the series of all metrics matching
+// the matchers, e.g. {__name__=~"a|b",namespace="rw"}.
+func namesSelector(metrics []string, matchers []*labels.Matcher) (string, error) {
+	escaped := make([]string, len(metrics))
+	for i, metric := range metrics {
+		escaped[i] = regexp.QuoteMeta(metric)
+	}
+	nameMatcher, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, strings.Join(escaped, "|"))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create metric name matcher")
+	}
+	return withMatchers("", append([]*labels.Matcher{nameMatcher}, matchers...)), nil
 }
 
 // queryAndMerge queries all time ranges and then merge the results
@@ -0,0 +1,37 @@
+package promdump
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpWithSelector(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/label/__name__/values": dataHandler(`["stream_rows"]`),
+		"/api/v1/query_range":           matrixHandler(""),
+	})
+
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoint:        srv.URL,
+		Start:           time.Unix(0, 0),
+		End:             time.Unix(60, 0),
+		Step:            time.Second,
+		Selector:        `{namespace="rw", pod=~"compute-.*"}`,
+		MetricsNames:    []string{"up"},
+		MetricsPatterns: []string{"stream_.*"},
+		MemoryRatio:     1,
+	}, io.Discard, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{`{namespace="rw", pod=~"compute-.*"}`}, srv.Values("/api/v1/label/__name__/values", "match[]"))
+	require.Equal(t, []string{`up{namespace="rw",pod=~"compute-.*"}`, `stream_rows{namespace="rw",pod=~"compute-.*"}`}, srv.Values("/api/v1/query_range", "query"))
+
+	_, err = selectorMatchers(`{__name__="up"}`)
+	require.Error(t, err)
+	_, err = selectorMatchers(`{namespace=}`)
+	require.Error(t, err)
+}
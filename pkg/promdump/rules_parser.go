@@ -0,0 +1,64 @@
+package promdump
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ruleFile is either a Prometheus rule file or a PrometheusRule resource of
+// the Prometheus operator, which has the groups under spec.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+	Spec   struct {
+		Groups []ruleGroup `yaml:"groups"`
+	} `yaml:"spec"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert  string `yaml:"alert"`
+	Record string `yaml:"record"`
+	Expr   string `yaml:"expr"`
+}
+
+// ParseRules retrieves the metrics names used by the alerting and recording
+// rules of the file. The file may contain several YAML documents. The result
+// accumulates the metrics of all dashboards and rules parsed by this parser.
+func (p *GrafanaDashboardParser) ParseRules(path string) (*ParseResult, error) {
+	content, err := readFileContent(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read rules from file %s", path)
+	}
+	resolver := newTemplateResolver(nil)
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var f ruleFile
+		if err := dec.Decode(&f); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal rules file %s", path)
+		}
+		for _, group := range append(f.Groups, f.Spec.Groups...) {
+			for _, r := range group.Rules {
+				usage := Usage{File: path, Group: group.Name, Source: "alert", Name: r.Alert, Expr: r.Expr}
+				if r.Record != "" {
+					usage.Source, usage.Name = "record", r.Record
+					if p.RecordedSeries {
+						p.addUsage(r.Record, usage)
+					}
+				}
+				if err := p.fetchMetricsNamesFromQuery(usage, resolver); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return p.result(), nil
+}
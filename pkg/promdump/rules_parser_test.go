@@ -0,0 +1,44 @@
+package promdump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+spec:
+  groups:
+  - name: rw
+    rules:
+    - record: job:barrier_latency:p99
+      expr: histogram_quantile(0.99, sum(rate(meta_barrier_duration_seconds_bucket[1m])) by (le, job))
+---
+groups:
+- name: node
+  rules:
+  - alert: Down
+    expr: up == 0
+  - alert: Broken
+    expr: sum(up
+`), 0644))
+
+	p := NewGrafanaDashboardParser()
+	result, err := p.ParseRules(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"meta_barrier_duration_seconds_bucket", "up"}, result.Metrics)
+	require.Equal(t, Usage{File: path, Group: "node", Source: "alert", Name: "Down", Expr: "up == 0"}, result.Lineage[1].Usages[0])
+	require.Len(t, result.Failures, 1)
+	require.Equal(t, "Broken", result.Failures[0].Name)
+
+	p = NewGrafanaDashboardParser()
+	p.RecordedSeries = true
+	result, err = p.ParseRules(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"job:barrier_latency:p99", "meta_barrier_duration_seconds_bucket", "up"}, result.Metrics)
+}
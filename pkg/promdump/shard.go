@@ -0,0 +1,148 @@
+package promdump
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	prom_model "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// tooLargeErrors are parts of the errors returned by Prometheus compatible
+// backends when a query selects too many series or samples.
+var tooLargeErrors = []string{
+	"too many samples",                          // Prometheus and Thanos
+	"exceeded the maximum number of series",     // Mimir and Cortex
+	"max-series-per-query",                      // Mimir
+	"cannot select more than",                   // VictoriaMetrics -search.maxSamplesPerQuery
+	"the number of matching timeseries exceeds", // VictoriaMetrics -search.maxUniqueTimeseries
+}
+
+func isTooLargeError(err error) bool {
+	msg := err.Error()
+	for _, s := range tooLargeErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// shardCallback is called for every matrix of the shards of a query, with
+// the progress of the query.
+type shardCallback func(query string, matrix prom_model.Matrix, progress float32) error
+
+// queryWithSharding runs the query on all time ranges. If the query is a
+// series selector with more than opt.ShardMaxSeries series, or if the backend
+// rejects it as too large, it is split into one query per value of a label,
+// see shardQuery.
+func queryWithSharding(ctx context.Context, v1api v1.API, query string, opt *DumpOpt, timeRanges []TimeRange, cb shardCallback) error {
+	matchers, err := parser.ParseMetricSelector(query)
+	canShard := err == nil
+
+	shards := []string{query}
+	if canShard && opt.ShardMaxSeries > 0 {
+		series, _, err := v1api.Series(ctx, []string{query}, opt.Start, opt.End)
+		if err != nil {
+			return errors.Wrap(err, "failed to get series")
+		}
+		if len(series) > opt.ShardMaxSeries {
+			if shards, err = shardQuery(ctx, v1api, matchers, opt); err != nil {
+				return err
+			}
+		}
+	}
+
+	sharded := len(shards) > 1
+	for si := 0; si < len(shards); si++ {
+		vs, warnings, err := queryAndMerge(ctx, v1api, shards[si], opt.Step, timeRanges)
+		if err != nil && canShard && !sharded && isTooLargeError(err) {
+			fmt.Printf("\nQuery %s is too large: %s\n", query, err)
+			if shards, err = shardQuery(ctx, v1api, matchers, opt); err != nil {
+				return err
+			}
+			sharded = true
+			si = -1
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to query range")
+		}
+		if len(warnings) > 0 {
+			return errors.Errorf("warnings: %v", warnings)
+		}
+		// traverse all matrices
+		for vi, v := range vs {
+			matrix, ok := v.(prom_model.Matrix)
+			if !ok {
+				return errors.New("value is not a matrix")
+			}
+			progress := (float32(si) + float32(vi+1)/float32(len(vs))) / float32(len(shards))
+			if err := cb(shards[si], matrix, progress); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shardQuery splits the selector into one selector per value of opt.ShardLabel,
+// or of the label with the most values, plus one for the series without it.
+func shardQuery(ctx context.Context, v1api v1.API, matchers []*labels.Matcher, opt *DumpOpt) ([]string, error) {
+	selector := withMatchers("", matchers)
+	label := opt.ShardLabel
+	if label == "" {
+		var err error
+		if label, err = highestCardinalityLabel(ctx, v1api, selector, opt); err != nil {
+			return nil, err
+		}
+	}
+	values, _, err := v1api.LabelValues(ctx, label, []string{selector}, opt.Start, opt.End)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get values of label %s", label)
+	}
+
+	shards := make([]string, 0, len(values)+1)
+	for _, value := range append(values, "") {
+		m, err := labels.NewMatcher(labels.MatchEqual, label, string(value))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create shard matcher")
+		}
+		shards = append(shards, withMatchers("", append(matchers[:len(matchers):len(matchers)], m)))
+	}
+	fmt.Printf("\nSharding %s by label %s into %d queries\n", selector, label, len(shards))
+	return shards, nil
+}
+
+// highestCardinalityLabel returns the label of the series of the selector
+// with the most values.
+func highestCardinalityLabel(ctx context.Context, v1api v1.API, selector string, opt *DumpOpt) (string, error) {
+	names, _, err := v1api.LabelNames(ctx, []string{selector}, opt.Start, opt.End)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get label names")
+	}
+	var (
+		best      string
+		bestCount int
+	)
+	for _, name := range names {
+		if name == labels.MetricName {
+			continue
+		}
+		values, _, err := v1api.LabelValues(ctx, name, []string{selector}, opt.Start, opt.End)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get values of label %s", name)
+		}
+		if len(values) > bestCount {
+			best, bestCount = name, len(values)
+		}
+	}
+	if best == "" {
+		return "", errors.Errorf("no label to shard %s", selector)
+	}
+	return best, nil
+}
@@ -0,0 +1,52 @@
+package promdump
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	prom_model "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpWithSharding(t *testing.T) {
+	srv := newFakeProm(t, map[string]http.HandlerFunc{
+		"/api/v1/labels":                dataHandler(`["__name__","actor_id","job"]`),
+		"/api/v1/label/actor_id/values": dataHandler(`["1","2"]`),
+		"/api/v1/label/job/values":      dataHandler(`["compute"]`),
+		"/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			if r.Form.Get("query") == "actor_rows" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprint(w, `{"status":"error","errorType":"execution","error":"query processing would load too many samples into memory in query execution"}`)
+				return
+			}
+			matrixHandler("")(w, r)
+		},
+	})
+
+	var progress []float32
+	err := DumpToWriter(context.Background(), &DumpOpt{
+		Endpoint:     srv.URL,
+		Start:        time.Unix(0, 0),
+		End:          time.Unix(60, 0),
+		Step:         time.Second,
+		MetricsNames: []string{"actor_rows"},
+		MemoryRatio:  1,
+	}, io.Discard, func(query string, _ prom_model.Matrix, value float32) error {
+		progress = append(progress, value)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"actor_rows",
+		`{__name__="actor_rows",actor_id="1"}`,
+		`{__name__="actor_rows",actor_id="2"}`,
+		`{__name__="actor_rows",actor_id=""}`,
+	}, srv.Values("/api/v1/query_range", "query"))
+	require.Equal(t, []string{`{__name__="actor_rows"}`}, srv.Values("/api/v1/labels", "match[]"))
+	require.NotEmpty(t, progress)
+	require.InDelta(t, 1, progress[len(progress)-1], 1e-6)
+}
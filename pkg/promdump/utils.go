@@ -8,8 +8,9 @@ type TimeRange struct {
 }
 
 // calTimeRanges calculates the time ranges for the given start and end time
-func calTimeRanges(start time.Time, end time.Time, step time.Duration, memoryRatio float32) []TimeRange {
-	maxDuration := time.Duration(float32(PrometheusDefaultMaxResolution)*memoryRatio) * step
+// with at most maxPoints points per series in each of them
+func calTimeRanges(start time.Time, end time.Time, step time.Duration, maxPoints int, memoryRatio float32) []TimeRange {
+	maxDuration := time.Duration(float32(maxPoints)*memoryRatio) * step
 	chunks := []TimeRange{}
 	for {
 		d := end.Sub(start)
@@ -21,8 +22,8 @@ func calTimeRanges(start time.Time, end time.Time, step time.Duration, memoryRat
 			break
 		}
 		chunks = append(chunks, TimeRange{
-			Start: start.Add(step), // last end is inclusive
-			End:   start.Add(maxDuration),
+			Start: start,
+			End:   start.Add(maxDuration - step), // the next chunk starts at the next step
 		})
 		start = start.Add(maxDuration)
 	}
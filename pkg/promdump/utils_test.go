@@ -0,0 +1,19 @@
+package promdump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalTimeRanges(t *testing.T) {
+	at := func(s int64) time.Time { return time.Unix(s, 0) }
+	// every step is in exactly one time range
+	require.Equal(t, []TimeRange{
+		{Start: at(0), End: at(39)},
+		{Start: at(40), End: at(79)},
+		{Start: at(80), End: at(100)},
+	}, calTimeRanges(at(0), at(100), time.Second, 40, 1))
+	require.Equal(t, []TimeRange{{Start: at(0), End: at(30)}}, calTimeRanges(at(0), at(30), time.Second, 40, 1))
+}
@@ -0,0 +1,134 @@
+package prompush
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Position identifies the input line an item was parsed from.
+type Position struct {
+	File string
+	Line int64
+}
+
+type FileCheckpoint struct {
+	// Line is the last input line acknowledged by a successful flush.
+	Line int64 `json:"line"`
+	// Done is set once every line of the file has been flushed.
+	Done bool `json:"done"`
+}
+
+// Checkpoint records the import progress of every input file, so that an
+// interrupted run can skip completed files and seek to the last acknowledged
+// line when resumed.
+type Checkpoint struct {
+	Files map[string]*FileCheckpoint `json:"files"`
+	// TimeShift is the time shift applied by the run, 0 if it was not
+	// shifted, so that a resumed run applies the same shift. It is nil if
+	// the run has not recorded it yet.
+	TimeShift *time.Duration `json:"time_shift,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func NewCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{
+		Files: make(map[string]*FileCheckpoint),
+		path:  path,
+	}
+}
+
+// LoadCheckpoint reads the checkpoint file at path. A missing file yields an
+// empty checkpoint.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	cp := NewCheckpoint(path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return nil, errors.Wrap(err, "failed to read checkpoint file")
+	}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal checkpoint file %s", path)
+	}
+	if cp.Files == nil {
+		cp.Files = make(map[string]*FileCheckpoint)
+	}
+	return cp, nil
+}
+
+func (c *Checkpoint) Get(file string) FileCheckpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fc, ok := c.Files[file]; ok {
+		return *fc
+	}
+	return FileCheckpoint{}
+}
+
+// Ack records that all lines up to pos have been flushed.
+func (c *Checkpoint) Ack(pos Position) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fc, ok := c.Files[pos.File]
+	if !ok {
+		fc = &FileCheckpoint{}
+		c.Files[pos.File] = fc
+	}
+	if pos.Line > fc.Line {
+		fc.Line = pos.Line
+	}
+	return c.save()
+}
+
+// MarkDone records that the file has been fully imported.
+func (c *Checkpoint) MarkDone(file string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fc, ok := c.Files[file]
+	if !ok {
+		fc = &FileCheckpoint{}
+		c.Files[file] = fc
+	}
+	fc.Done = true
+	return c.save()
+}
+
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+// save writes the checkpoint to a temporary file and renames it, so a crash
+// never leaves a truncated checkpoint behind.
+func (c *Checkpoint) save() error {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal checkpoint")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary checkpoint file")
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to close checkpoint file")
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return errors.Wrap(err, "failed to rename checkpoint file")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package prompush
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordTarget records the written series, or fails every write with err.
+type recordTarget struct {
+	mu     sync.Mutex
+	series []*Series
+	err    error
+}
+
+func (r *recordTarget) Name() string {
+	return "record"
+}
+
+func (r *recordTarget) SupportsHistograms() bool {
+	return true
+}
+
+func (r *recordTarget) Write(ctx context.Context, batch []*Series) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.series = append(r.series, batch...)
+	return nil
+}
+
+func TestCheckpointPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp := NewCheckpoint(path)
+	require.NoError(t, cp.Ack(Position{File: "a", Line: 10}))
+	// acks never move backwards
+	require.NoError(t, cp.Ack(Position{File: "a", Line: 5}))
+	require.NoError(t, cp.MarkDone("b"))
+
+	loaded, err := LoadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, FileCheckpoint{Line: 10}, loaded.Get("a"))
+	require.Equal(t, FileCheckpoint{Done: true}, loaded.Get("b"))
+	require.Equal(t, FileCheckpoint{}, loaded.Get("c"))
+
+	// a missing checkpoint is empty
+	empty, err := LoadCheckpoint(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	require.Empty(t, empty.Files)
+}
+
+func TestNDJSONPusherSkipLines(t *testing.T) {
+	target := &recordTarget{}
+	pw := NewPushWorker(context.Background(), &PushWorkerCfg{Target: target, BatchSize: 10})
+	defer pw.Close()
+
+	input := `{"metric":{"__name__":"a"},"values":[[1,"1"]]}` + "\n" +
+		`{"metric":{"__name__":"b"},"values":[[1,"1"]]}` + "\n"
+	err := (&NDJSONPusher{}).Push(context.Background(), strings.NewReader(input), pw, &PushOpt{
+		File:         "f",
+		SkipLines:    1,
+		ShowProgress: func() error { return nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, pw.Sync(context.Background()))
+	require.Len(t, target.series, 1)
+	require.Equal(t, "b", target.series[0].Metric["__name__"])
+}
+
+func TestFailedFlushDoesNotAck(t *testing.T) {
+	cp := NewCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	target := &recordTarget{err: errors.New("unavailable")}
+	pw := NewPushWorker(context.Background(), &PushWorkerCfg{Target: target, BatchSize: 10, OnFlush: cp.Ack})
+	defer pw.Close()
+
+	pw.Push(&Series{Metric: map[string]string{"__name__": "a"}, Timestamps: []int64{1}, Values: []float64{1}}, Position{File: "f", Line: 1})
+	require.Error(t, pw.Sync(context.Background()))
+	require.Equal(t, FileCheckpoint{}, cp.Get("f"))
+
+	target.mu.Lock()
+	target.err = nil
+	target.mu.Unlock()
+	require.NoError(t, pw.Sync(context.Background()))
+	require.Equal(t, FileCheckpoint{Line: 1}, cp.Get("f"))
+}
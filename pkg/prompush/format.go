@@ -0,0 +1,139 @@
+package prompush
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+	prom_model "github.com/prometheus/common/model"
+	"github.com/risingwavelabs/promdump/utils"
+)
+
+// LegacyFormat is a series in the format of the Prometheus query API, as
+// written by promdump.
+type LegacyFormat struct {
+	Metric     map[string]string                `json:"metric"`
+	Values     []LegacySample                   `json:"values"`
+	Histograms []prom_model.SampleHistogramPair `json:"histograms"`
+}
+
+// LegacySample is a [timestamp, "value"] pair of the Prometheus query API.
+// The timestamp is in seconds, and the value may also be a plain number.
+type LegacySample struct {
+	// Timestamp in milliseconds
+	Timestamp int64
+	Value     float64
+}
+
+func (s *LegacySample) UnmarshalJSON(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return errors.Errorf("sample must be a [timestamp, value] pair, got %s", utils.TruncateString(string(b), 32))
+	}
+	if len(pair) != 2 {
+		return errors.Errorf("sample must be a [timestamp, value] pair, got %d elements", len(pair))
+	}
+
+	var ts json.Number
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return errors.Errorf("sample timestamp must be a number, got %s", utils.TruncateString(string(pair[0]), 32))
+	}
+	sec, err := strconv.ParseFloat(string(ts), 64)
+	if err != nil || math.IsInf(sec, 0) || math.IsNaN(sec) {
+		return errors.Errorf("invalid sample timestamp %s", utils.TruncateString(string(pair[0]), 32))
+	}
+
+	if bytes.Equal(bytes.TrimSpace(pair[1]), []byte("null")) {
+		return errors.New("sample value must not be null")
+	}
+	var v SampleValue
+	if err := v.UnmarshalJSON(bytes.TrimSpace(pair[1])); err != nil {
+		return errors.Errorf("invalid sample value %s", utils.TruncateString(string(pair[1]), 32))
+	}
+
+	s.Timestamp = int64(math.Round(sec * 1000))
+	s.Value = float64(v)
+	return nil
+}
+
+// Item is a series in the JSON line format of the VictoriaMetrics import API.
+type Item struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []SampleValue     `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// decodeLine decodes a line of a dump, either in the format of the Prometheus
+// query API, or in the format of Item, as written by `promdump dump --source vm-export`.
+func decodeLine(line []byte) (*LegacyFormat, error) {
+	var raw struct {
+		Metric     map[string]string                `json:"metric"`
+		Values     json.RawMessage                  `json:"values"`
+		Timestamps []int64                          `json:"timestamps"`
+		Histograms []prom_model.SampleHistogramPair `json:"histograms"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+	legacy := &LegacyFormat{Metric: raw.Metric, Histograms: raw.Histograms}
+	if len(raw.Values) == 0 || bytes.Equal(raw.Values, []byte("null")) {
+		return legacy, nil
+	}
+	if raw.Timestamps == nil {
+		if err := json.Unmarshal(raw.Values, &legacy.Values); err != nil {
+			return nil, err
+		}
+		return legacy, nil
+	}
+
+	var values []SampleValue
+	if err := json.Unmarshal(raw.Values, &values); err != nil {
+		return nil, err
+	}
+	if len(values) != len(raw.Timestamps) {
+		return nil, errors.Errorf("got %d values and %d timestamps", len(values), len(raw.Timestamps))
+	}
+	legacy.Values = make([]LegacySample, len(values))
+	for i, v := range values {
+		legacy.Values[i] = LegacySample{Timestamp: raw.Timestamps[i], Value: float64(v)}
+	}
+	return legacy, nil
+}
+
+// SampleValue is a float64 that encodes NaN and ±Inf as strings, which
+// encoding/json refuses to marshal but VictoriaMetrics accepts.
+type SampleValue float64
+
+func (v SampleValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(f)
+}
+
+func (v *SampleValue) UnmarshalJSON(b []byte) error {
+	var f float64
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse value %q", s)
+		}
+		f = parsed
+	} else if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*v = SampleValue(f)
+	return nil
+}
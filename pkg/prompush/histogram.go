@@ -0,0 +1,127 @@
+package prompush
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	prom_model "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+)
+
+// HistogramSample is a native histogram sample.
+type HistogramSample struct {
+	// Timestamp in milliseconds
+	Timestamp int64
+	Histogram *histogram.FloatHistogram
+}
+
+// Series is a parsed series ready to be written to a target.
+type Series struct {
+	Metric map[string]string
+	// Timestamps and Values are the float samples, Timestamps are in milliseconds
+	Timestamps []int64
+	Values     []float64
+	Histograms []HistogramSample
+}
+
+type histogramBucket struct {
+	index int32
+	count float64
+}
+
+// toFloatHistogram converts a histogram in the bucket form of the Prometheus
+// query API back to its sparse representation. The schema is inferred from the
+// bucket boundaries, as the API doesn't return it. Custom bucket histograms
+// are not supported because empty buckets are omitted by the API, which makes
+// their boundaries ambiguous.
+func toFloatHistogram(h *prom_model.SampleHistogram) (*histogram.FloatHistogram, error) {
+	fh := &histogram.FloatHistogram{
+		Count: float64(h.Count),
+		Sum:   float64(h.Sum),
+	}
+	var (
+		positive, negative []histogramBucket
+		schema             int32
+		schemaFound        bool
+	)
+	for _, b := range h.Buckets {
+		lower, upper := float64(b.Lower), float64(b.Upper)
+		if lower <= 0 && upper >= 0 { // the zero bucket
+			fh.ZeroThreshold = upper
+			fh.ZeroCount = float64(b.Count)
+			continue
+		}
+
+		// buckets are symmetric around zero
+		absLower, absUpper := lower, upper
+		if upper < 0 {
+			absLower, absUpper = -upper, -lower
+		}
+		s, err := inferSchema(absLower, absUpper)
+		if err != nil {
+			return nil, err
+		}
+		if schemaFound && s != schema {
+			return nil, errors.Errorf("inconsistent bucket schemas %d and %d", schema, s)
+		}
+		schema, schemaFound = s, true
+
+		// the bucket with index i covers (base^(i-1), base^i] where base is 2^(2^-schema)
+		index := int32(math.Round(math.Log2(absUpper) * math.Exp2(float64(s))))
+		if upper < 0 {
+			negative = append(negative, histogramBucket{index: index, count: float64(b.Count)})
+		} else {
+			positive = append(positive, histogramBucket{index: index, count: float64(b.Count)})
+		}
+	}
+	fh.Schema = schema
+	fh.PositiveSpans, fh.PositiveBuckets = toSpans(positive)
+	fh.NegativeSpans, fh.NegativeBuckets = toSpans(negative)
+	if err := fh.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid histogram")
+	}
+	return fh, nil
+}
+
+// inferSchema returns the exponential schema of a bucket with the given
+// positive boundaries.
+func inferSchema(lower, upper float64) (int32, error) {
+	if lower <= 0 || upper <= lower {
+		return 0, errors.Errorf("invalid bucket boundaries (%g, %g]", lower, upper)
+	}
+	// upper / lower = 2^(2^-schema)
+	width := math.Log2(upper / lower)
+	schema := math.Round(-math.Log2(width))
+	if schema < float64(histogram.ExponentialSchemaMin) || schema > float64(histogram.ExponentialSchemaMax) ||
+		math.Abs(math.Exp2(-schema)-width) > 1e-6*width {
+		return 0, errors.Errorf("bucket (%g, %g] doesn't match any exponential schema, custom buckets are not supported", lower, upper)
+	}
+	return int32(schema), nil
+}
+
+// toSpans sorts the buckets by index and encodes them as spans and absolute counts.
+func toSpans(buckets []histogramBucket) ([]histogram.Span, []float64) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].index < buckets[j].index
+	})
+	var (
+		spans  []histogram.Span
+		counts []float64
+	)
+	for i, b := range buckets {
+		switch {
+		case i == 0:
+			spans = append(spans, histogram.Span{Offset: b.index, Length: 1})
+		case b.index == buckets[i-1].index+1:
+			spans[len(spans)-1].Length++
+		default:
+			spans = append(spans, histogram.Span{Offset: b.index - buckets[i-1].index - 1, Length: 1})
+		}
+		counts = append(counts, b.count)
+	}
+	return spans, counts
+}
@@ -7,57 +7,127 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/risingwavelabs/promdump/utils"
 )
 
 type Pusher interface {
-	Push(ctx context.Context, reader io.Reader, pw *PushWorker, showProgress func() error, ignoreInvalidFiles bool) error
+	Push(ctx context.Context, reader io.Reader, pw *PushWorker, opt *PushOpt) error
+	// LastTimestamp returns the latest sample timestamp in milliseconds, or 0 if there is no sample.
+	LastTimestamp(ctx context.Context, reader io.Reader) (int64, error)
 }
 
-type NDJSONPusher struct {
+type PushOpt struct {
+	// File is the name of the input file, used as the checkpoint key
+	File string
+	// SkipLines is the number of leading lines already imported by a previous run
+	SkipLines          int64
+	ShowProgress       func() error
+	IgnoreInvalidFiles bool
+	Parse              *ParseOpt
+	Stats              *ParseStats
+}
+
+// NonFinitePolicy decides what to do with NaN and ±Inf samples.
+type NonFinitePolicy string
+
+const (
+	// NonFiniteDrop drops the NaN and ±Inf samples and keeps the rest of the series
+	NonFiniteDrop NonFinitePolicy = "drop"
+	// NonFiniteKeep keeps the NaN and ±Inf samples as is, VictoriaMetrics accepts them
+	NonFiniteKeep NonFinitePolicy = "keep"
+)
+
+// ParseStats counts what was dropped or kept while parsing.
+type ParseStats struct {
+	Series        int64
+	Samples       int64
+	DroppedNaN    int64
+	DroppedInf    int64
+	KeptNonFinite int64
+	Histograms    int64
+	// SkippedHistograms counts native histogram samples that can't be converted or written to the target
+	SkippedHistograms int64
+	EmptySeries       int64
+}
+
+func (s *ParseStats) String() string {
+	return fmt.Sprintf(
+		"%d series, %d samples, %d histogram samples, dropped %d NaN samples, dropped %d Inf samples, kept %d non-finite samples, skipped %d histogram samples, skipped %d empty series",
+		s.Series, s.Samples, s.Histograms, s.DroppedNaN, s.DroppedInf, s.KeptNonFinite, s.SkippedHistograms, s.EmptySeries,
+	)
 }
 
-type LegacyFormat struct {
-	Metric map[string]string `json:"metric"`
-	Values [][]any           `json:"values"`
+// ParseOpt controls how dumped series are rewritten before being pushed.
+type ParseOpt struct {
+	// TimeShift is added to every timestamp
+	TimeShift time.Duration
+	// ShiftLabel is the name of the label recording TimeShift, no label is added if empty
+	ShiftLabel string
+	// ExtraLabels are added to every series, overriding existing labels with the same name
+	ExtraLabels map[string]string
+	// LabelPrefix is prepended to the names of all labels of the series except __name__
+	LabelPrefix string
+	// NonFinite is the policy for NaN and ±Inf samples, default is NonFiniteDrop
+	NonFinite NonFinitePolicy
 }
 
-type Item struct {
-	Metric     map[string]string `json:"metric"`
-	Values     []float64         `json:"values"`
-	Timestamps []int64           `json:"timestamps"`
+// rewriteLabels applies the label options to the labels of a series. The
+// original map is returned as is if there is nothing to rewrite.
+func (opt *ParseOpt) rewriteLabels(metric map[string]string) map[string]string {
+	if len(opt.ShiftLabel) == 0 && len(opt.ExtraLabels) == 0 && len(opt.LabelPrefix) == 0 {
+		return metric
+	}
+	ret := make(map[string]string, len(metric)+len(opt.ExtraLabels)+1)
+	for k, v := range metric {
+		if k != "__name__" {
+			k = opt.LabelPrefix + k
+		}
+		ret[k] = v
+	}
+	for k, v := range opt.ExtraLabels {
+		ret[k] = v
+	}
+	if len(opt.ShiftLabel) > 0 {
+		ret[opt.ShiftLabel] = opt.TimeShift.String()
+	}
+	return ret
+}
+
+type NDJSONPusher struct {
 }
 
-func (n *NDJSONPusher) Push(ctx context.Context, reader io.Reader, pw *PushWorker, showProgress func() error, ignoreInvalidFiles bool) error {
+func (n *NDJSONPusher) Push(ctx context.Context, reader io.Reader, pw *PushWorker, opt *PushOpt) error {
 	scanner := bufio.NewScanner(reader)
 	scanner.Buffer(make([]byte, 1024*1024), 1*1024*1024*1024) // 1GB max line size
+	var lineNo int64
 	for scanner.Scan() {
 		line := scanner.Bytes()
+		lineNo++
 
-		if err := showProgress(); err != nil {
+		if err := opt.ShowProgress(); err != nil {
 			return errors.Wrap(err, "failed to show progress")
 		}
 
-		if len(line) == 0 {
+		if len(line) == 0 || lineNo <= opt.SkipLines {
 			continue
 		}
 
-		var legacy LegacyFormat
-		if err := json.Unmarshal(line, &legacy); err != nil {
-			return fmt.Errorf("failed to unmarshal line: %w, line=%s", err, string(line))
+		legacy, err := decodeLine(line)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal line %d: %w, line=%s", lineNo, err, utils.TruncateString(string(line), 100))
 		}
-		line, err := parseLegacyFormat(&legacy)
+		series, err := parseLegacyFormat(legacy, opt.Parse, opt.Stats)
 		if err != nil {
-			if errors.Is(err, ErrNaNValues) || errors.Is(err, ErrZeroTimestamp) || errors.Is(err, ErrInfValues) {
-				fmt.Printf("\n%s, skipping line: %v\n", err.Error(), utils.TruncateString(string(line), 100))
+			if errors.Is(err, ErrZeroTimestamp) {
 				continue
 			}
-			return errors.Wrapf(err, "failed to parse legacy format")
+			return errors.Wrapf(err, "failed to parse legacy format at line %d", lineNo)
 		}
-		pw.Push(line)
+		pushSeries(pw, series, opt, Position{File: opt.File, Line: lineNo})
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -67,6 +137,31 @@ func (n *NDJSONPusher) Push(ctx context.Context, reader io.Reader, pw *PushWorke
 	return nil
 }
 
+func (n *NDJSONPusher) LastTimestamp(ctx context.Context, reader io.Reader) (int64, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 1024*1024), 1*1024*1024*1024) // 1GB max line size
+	var (
+		last   int64
+		lineNo int64
+	)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineNo++
+		if len(line) == 0 {
+			continue
+		}
+		legacy, err := decodeLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal line %d: %w, line=%s", lineNo, err, utils.TruncateString(string(line), 100))
+		}
+		last = max(last, lastTimestamp(legacy))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading file: %w", err)
+	}
+	return last, nil
+}
+
 type AWSManagedPrometheusPusher struct {
 }
 
@@ -80,14 +175,14 @@ type AWSManagedPrometheusQueryResponse struct {
 	Data   AWSManagedPrometheusQueryData `json:"data"`
 }
 
-func (a *AWSManagedPrometheusPusher) Push(ctx context.Context, reader io.Reader, pw *PushWorker, showProgress func() error, ignoreInvalidFiles bool) error {
+func (a *AWSManagedPrometheusPusher) Push(ctx context.Context, reader io.Reader, pw *PushWorker, opt *PushOpt) error {
 	data, err := io.ReadAll(reader)
 	if err != nil {
 		return errors.Wrapf(err, "failed to read data")
 	}
 	var res AWSManagedPrometheusQueryResponse
 	if err := json.Unmarshal(data, &res); err != nil {
-		if ignoreInvalidFiles {
+		if opt.IgnoreInvalidFiles {
 			fmt.Printf("\nfailed to unmarshal data, ignoring invalid file: %v\n", err)
 			return nil
 		}
@@ -102,53 +197,125 @@ func (a *AWSManagedPrometheusPusher) Push(ctx context.Context, reader io.Reader,
 		return errors.Errorf("expect `matrix` result type, got: `%s`", res.Data.ResultType)
 	}
 
-	for _, legacy := range res.Data.Result {
-		line, err := parseLegacyFormat(&legacy)
+	// each result is treated as a line of the file
+	for i, legacy := range res.Data.Result {
+		lineNo := int64(i + 1)
+		if lineNo <= opt.SkipLines {
+			continue
+		}
+		series, err := parseLegacyFormat(&legacy, opt.Parse, opt.Stats)
 		if err != nil {
-			if errors.Is(err, ErrNaNValues) || errors.Is(err, ErrZeroTimestamp) || errors.Is(err, ErrInfValues) {
-				fmt.Printf("\n%s, skipping line: %v\n", err.Error(), utils.TruncateString(string(line), 100))
+			if errors.Is(err, ErrZeroTimestamp) {
 				continue
 			}
-			return errors.Wrapf(err, "failed to parse legacy format")
+			return errors.Wrapf(err, "failed to parse legacy format at result %d", lineNo)
 		}
-		pw.Push(line)
+		pushSeries(pw, series, opt, Position{File: opt.File, Line: lineNo})
 	}
 
 	return nil
 }
 
+func (a *AWSManagedPrometheusPusher) LastTimestamp(ctx context.Context, reader io.Reader) (int64, error) {
+	var res AWSManagedPrometheusQueryResponse
+	if err := json.NewDecoder(reader).Decode(&res); err != nil {
+		return 0, errors.Wrapf(err, "failed to unmarshal data")
+	}
+	var last int64
+	for _, legacy := range res.Data.Result {
+		last = max(last, lastTimestamp(&legacy))
+	}
+	return last, nil
+}
+
 var (
-	ErrInfValues     = errors.Errorf("Inf values found")
-	ErrNaNValues     = errors.Errorf("NaN values found")
 	ErrZeroTimestamp = errors.Errorf("zero timestamp found")
 )
 
-func parseLegacyFormat(legacy *LegacyFormat) ([]byte, error) {
-	item := Item{
-		Metric: legacy.Metric,
+// lastTimestamp returns the latest timestamp of the series in milliseconds
+func lastTimestamp(legacy *LegacyFormat) int64 {
+	var last int64
+	for _, v := range legacy.Values {
+		last = max(last, v.Timestamp)
+	}
+	for _, h := range legacy.Histograms {
+		last = max(last, int64(h.Timestamp))
 	}
+	return last
+}
+
+func parseLegacyFormat(legacy *LegacyFormat, opt *ParseOpt, stats *ParseStats) (*Series, error) {
+	if opt == nil {
+		opt = &ParseOpt{}
+	}
+	if stats == nil {
+		stats = &ParseStats{}
+	}
+	series := &Series{
+		Metric: opt.rewriteLabels(legacy.Metric),
+	}
+	shift := opt.TimeShift.Milliseconds()
 
 	for _, v := range legacy.Values {
-		val, err := strconv.ParseFloat(v[1].(string), 64)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse value")
+		val := v.Value
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			if opt.NonFinite == NonFiniteKeep {
+				stats.KeptNonFinite++
+			} else if math.IsNaN(val) {
+				stats.DroppedNaN++
+				continue
+			} else {
+				stats.DroppedInf++
+				continue
+			}
 		}
-		if math.IsInf(val, 0) {
-			return nil, ErrInfValues
+		series.Timestamps = append(series.Timestamps, v.Timestamp+shift)
+		series.Values = append(series.Values, val)
+	}
+
+	for _, h := range legacy.Histograms {
+		if h.Histogram == nil {
+			continue
 		}
-		if math.IsNaN(val) {
-			return nil, ErrNaNValues
+		fh, err := toFloatHistogram(h.Histogram)
+		if err != nil {
+			fmt.Printf("\nwarning: skipping %d histogram samples of %s: %v\n", len(legacy.Histograms), labels.FromMap(legacy.Metric), err)
+			stats.SkippedHistograms += int64(len(legacy.Histograms))
+			series.Histograms = nil
+			break
 		}
-		item.Timestamps = append(item.Timestamps, int64(1000*v[0].(float64)))
-		item.Values = append(item.Values, val)
+		series.Histograms = append(series.Histograms, HistogramSample{
+			Timestamp: int64(h.Timestamp) + shift,
+			Histogram: fh,
+		})
 	}
-	if len(item.Timestamps) == 0 {
+
+	if len(series.Timestamps) == 0 && len(series.Histograms) == 0 {
+		stats.EmptySeries++
 		return nil, ErrZeroTimestamp
 	}
-	l, err := json.Marshal(item)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal item")
+	return series, nil
+}
+
+// pushSeries pushes the series to the worker. Histogram samples are dropped
+// with a warning if the target doesn't support them.
+func pushSeries(pw *PushWorker, series *Series, opt *PushOpt, pos Position) {
+	stats := opt.Stats
+	if stats == nil {
+		stats = &ParseStats{}
+	}
+	if len(series.Histograms) > 0 && !pw.SupportsHistograms() {
+		fmt.Printf("\nwarning: %s doesn't support native histograms, skipping %d histogram samples of %s\n",
+			pw.TargetName(), len(series.Histograms), labels.FromMap(series.Metric))
+		stats.SkippedHistograms += int64(len(series.Histograms))
+		series.Histograms = nil
+		if len(series.Timestamps) == 0 {
+			stats.EmptySeries++
+			return
+		}
 	}
-	l = append(l, '\n')
-	return l, nil
+	stats.Series++
+	stats.Samples += int64(len(series.Timestamps))
+	stats.Histograms += int64(len(series.Histograms))
+	pw.Push(series, pos)
 }
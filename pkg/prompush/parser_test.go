@@ -0,0 +1,231 @@
+package prompush
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacySampleUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    LegacySample
+		wantErr bool
+	}{
+		{name: "float timestamp", input: `[1700000000.123, "1.5"]`, want: LegacySample{Timestamp: 1700000000123, Value: 1.5}},
+		{name: "integer timestamp", input: `[1700000000, "2"]`, want: LegacySample{Timestamp: 1700000000000, Value: 2}},
+		{name: "numeric value", input: `[1, 3.25]`, want: LegacySample{Timestamp: 1000, Value: 3.25}},
+		{name: "string timestamp", input: `["1.5", "1"]`, want: LegacySample{Timestamp: 1500, Value: 1}},
+		{name: "NaN", input: `[1, "NaN"]`, want: LegacySample{Timestamp: 1000, Value: math.NaN()}},
+		{name: "Inf", input: `[1, "+Inf"]`, want: LegacySample{Timestamp: 1000, Value: math.Inf(1)}},
+		{name: "too few elements", input: `[1]`, wantErr: true},
+		{name: "too many elements", input: `[1, "1", "1"]`, wantErr: true},
+		{name: "not an array", input: `{"t": 1}`, wantErr: true},
+		{name: "invalid timestamp", input: `["x", "1"]`, wantErr: true},
+		{name: "invalid value", input: `[1, "x"]`, wantErr: true},
+		{name: "null value", input: `[1, null]`, wantErr: true},
+		{name: "object value", input: `[1, {}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s LegacySample
+			err := json.Unmarshal([]byte(tt.input), &s)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want.Timestamp, s.Timestamp)
+			if math.IsNaN(tt.want.Value) {
+				require.True(t, math.IsNaN(s.Value))
+			} else {
+				require.Equal(t, tt.want.Value, s.Value)
+			}
+		})
+	}
+}
+
+func TestParseLegacyFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		opt     *ParseOpt
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "plain",
+			input: `{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"],[2,"0"]]}`,
+			want:  `{"metric":{"__name__":"up","job":"a"},"values":[1,0],"timestamps":[1000,2000]}`,
+		},
+		{
+			name:  "drop non-finite samples",
+			input: `{"metric":{"__name__":"up"},"values":[[1,"NaN"],[2,"1"],[3,"-Inf"]]}`,
+			want:  `{"metric":{"__name__":"up"},"values":[1],"timestamps":[2000]}`,
+		},
+		{
+			name:  "keep non-finite samples",
+			input: `{"metric":{"__name__":"up"},"values":[[1,"NaN"],[2,"+Inf"]]}`,
+			opt:   &ParseOpt{NonFinite: NonFiniteKeep},
+			want:  `{"metric":{"__name__":"up"},"values":["NaN","+Inf"],"timestamps":[1000,2000]}`,
+		},
+		{
+			name:  "rewrite labels",
+			input: `{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"]]}`,
+			opt:   &ParseOpt{LabelPrefix: "src_", ExtraLabels: map[string]string{"source": "x"}},
+			want:  `{"metric":{"__name__":"up","source":"x","src_job":"a"},"values":[1],"timestamps":[1000]}`,
+		},
+		{
+			name:    "invalid histograms only",
+			input:   `{"metric":{"__name__":"h"},"histograms":[[1,{"count":"1","sum":"1","buckets":[[0,"3","5","1"]]}]]}`,
+			wantErr: ErrZeroTimestamp,
+		},
+		{
+			name:    "all samples dropped",
+			input:   `{"metric":{"__name__":"up"},"values":[[1,"NaN"]]}`,
+			wantErr: ErrZeroTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var legacy LegacyFormat
+			require.NoError(t, json.Unmarshal([]byte(tt.input), &legacy))
+			series, err := parseLegacyFormat(&legacy, tt.opt, nil)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			line, err := marshalItem(series)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(line))
+		})
+	}
+}
+
+func TestToFloatHistogram(t *testing.T) {
+	var legacy LegacyFormat
+	require.NoError(t, json.Unmarshal([]byte(`{"metric":{"__name__":"h"},"histograms":[[1.5,{
+		"count":"8","sum":"20",
+		"buckets":[[1,"-2","-1","1"],[3,"-0.001","0.001","1"],[0,"1","2","3"],[0,"2","4","1"],[0,"8","16","2"]]
+	}]]}`), &legacy))
+
+	series, err := parseLegacyFormat(&legacy, &ParseOpt{TimeShift: time.Second}, nil)
+	require.NoError(t, err)
+	require.Empty(t, series.Timestamps)
+	require.Len(t, series.Histograms, 1)
+	require.Equal(t, int64(2500), series.Histograms[0].Timestamp)
+
+	fh := series.Histograms[0].Histogram
+	require.Equal(t, int32(0), fh.Schema)
+	require.Equal(t, 8.0, fh.Count)
+	require.Equal(t, 20.0, fh.Sum)
+	require.Equal(t, 0.001, fh.ZeroThreshold)
+	require.Equal(t, 1.0, fh.ZeroCount)
+	require.Equal(t, []histogram.Span{{Offset: 1, Length: 2}, {Offset: 1, Length: 1}}, fh.PositiveSpans)
+	require.Equal(t, []float64{3, 1, 2}, fh.PositiveBuckets)
+	require.Equal(t, []histogram.Span{{Offset: 1, Length: 1}}, fh.NegativeSpans)
+	require.Equal(t, []float64{1}, fh.NegativeBuckets)
+}
+
+func TestNDJSONPusherLineNumber(t *testing.T) {
+	pw := NewPushWorker(context.Background(), &PushWorkerCfg{Target: &NoopTarget{}, BatchSize: 10})
+	defer pw.Close()
+
+	input := `{"metric":{"__name__":"up"},"values":[[1,"1"]]}` + "\n" +
+		`{"metric":{"__name__":"up"},"values":[[1]]}` + "\n"
+	err := (&NDJSONPusher{}).Push(context.Background(), strings.NewReader(input), pw, &PushOpt{
+		ShowProgress: func() error { return nil },
+	})
+	require.ErrorContains(t, err, "line 2")
+}
+
+func FuzzParseLegacyFormat(f *testing.F) {
+	f.Add([]byte(`{"metric":{"__name__":"up"},"values":[[1700000000.123,"1"],[1700000001,"NaN"]]}`))
+	f.Add([]byte(`{"metric":{"__name__":"up"},"values":[[1,2]]}`))
+	f.Add([]byte(`{"metric":{"__name__":"h"},"histograms":[[1,{"count":"1","sum":"1","buckets":[[0,"0","1","1"]]}]]}`))
+	f.Add([]byte(`{"metric":{},"values":[["1",null]]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var legacy LegacyFormat
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return
+		}
+		series, err := parseLegacyFormat(&legacy, &ParseOpt{NonFinite: NonFiniteKeep}, nil)
+		if err != nil {
+			return
+		}
+		line, err := marshalItem(series)
+		require.NoError(t, err)
+		var item Item
+		require.NoError(t, json.Unmarshal(line, &item))
+		require.Equal(t, len(item.Timestamps), len(item.Values))
+	})
+}
+
+func TestDecodeLine(t *testing.T) {
+	legacy, err := decodeLine([]byte(`{"metric":{"__name__":"up"},"values":[[1.5,"1"],[3,"NaN"]]}`))
+	require.NoError(t, err)
+	require.Len(t, legacy.Values, 2)
+	require.Equal(t, LegacySample{Timestamp: 1500, Value: 1}, legacy.Values[0])
+	require.True(t, math.IsNaN(legacy.Values[1].Value))
+
+	item, err := decodeLine([]byte(`{"metric":{"__name__":"up","job":"rw"},"values":[1,"+Inf"],"timestamps":[1500,3000]}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"__name__": "up", "job": "rw"}, item.Metric)
+	require.Equal(t, []LegacySample{{Timestamp: 1500, Value: 1}, {Timestamp: 3000, Value: math.Inf(1)}}, item.Values)
+
+	_, err = decodeLine([]byte(`{"metric":{"__name__":"up"},"values":[1,2],"timestamps":[1500]}`))
+	require.Error(t, err)
+}
+
+func TestRewriteLabels(t *testing.T) {
+	metric := map[string]string{"__name__": "up", "env": "dev", "job": "rw"}
+	opt := &ParseOpt{LabelPrefix: "src_", ExtraLabels: map[string]string{"env": "prod", "src_job": "replay"}}
+	// extra labels are added after the prefix, and override the prefixed labels
+	require.Equal(t, map[string]string{"__name__": "up", "src_env": "dev", "src_job": "replay", "env": "prod"}, opt.rewriteLabels(metric))
+
+	opt = &ParseOpt{ExtraLabels: map[string]string{"env": "prod"}}
+	require.Equal(t, map[string]string{"__name__": "up", "env": "prod", "job": "rw"}, opt.rewriteLabels(metric))
+	// the original labels are untouched
+	require.Equal(t, "dev", metric["env"])
+}
+
+func TestParseStats(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	legacy := &LegacyFormat{
+		Metric: map[string]string{"__name__": "up"},
+		Values: []LegacySample{
+			{Timestamp: 1000, Value: 1},
+			{Timestamp: 2000, Value: math.NaN()},
+			{Timestamp: 3000, Value: stale},
+			{Timestamp: 4000, Value: math.Inf(1)},
+			{Timestamp: 5000, Value: math.Inf(-1)},
+		},
+	}
+
+	stats := &ParseStats{}
+	series, err := parseLegacyFormat(legacy, nil, stats)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1000}, series.Timestamps)
+	_, err = parseLegacyFormat(&LegacyFormat{Values: []LegacySample{{Timestamp: 1000, Value: math.NaN()}}}, nil, stats)
+	require.ErrorIs(t, err, ErrZeroTimestamp)
+	require.Equal(t, ParseStats{DroppedNaN: 3, DroppedInf: 2, EmptySeries: 1}, *stats)
+
+	stats = &ParseStats{}
+	series, err = parseLegacyFormat(legacy, &ParseOpt{NonFinite: NonFiniteKeep}, stats)
+	require.NoError(t, err)
+	require.Len(t, series.Values, 5)
+	// stale markers are kept as is
+	require.True(t, value.IsStaleNaN(series.Values[2]))
+	require.Equal(t, ParseStats{KeptNonFinite: 4}, *stats)
+
+	require.Equal(t, "0 series, 0 samples, 0 histogram samples, dropped 0 NaN samples, dropped 0 Inf samples, kept 4 non-finite samples, skipped 0 histogram samples, skipped 0 empty series", stats.String())
+}
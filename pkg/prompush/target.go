@@ -0,0 +1,194 @@
+package prompush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Target is where the parsed series are written to.
+type Target interface {
+	// Name is used in logs and warnings
+	Name() string
+	// SupportsHistograms reports whether native histogram samples can be written
+	SupportsHistograms() bool
+	Write(ctx context.Context, batch []*Series) error
+}
+
+// Syncer is implemented by the targets that buffer the written series, which
+// are only persisted by Sync.
+type Syncer interface {
+	Sync(ctx context.Context) error
+}
+
+// NoopTarget discards all series.
+type NoopTarget struct {
+}
+
+func (n *NoopTarget) Name() string {
+	return "noop"
+}
+
+func (n *NoopTarget) SupportsHistograms() bool {
+	return true
+}
+
+func (n *NoopTarget) Write(ctx context.Context, batch []*Series) error {
+	return nil
+}
+
+// VMImportTarget writes series to the JSON line import API of VictoriaMetrics.
+type VMImportTarget struct {
+	Endpoint string
+	// Tenant is the <accountID>[:<projectID>] tenant of a VictoriaMetrics
+	// cluster, Endpoint is then its vminsert component
+	Tenant string
+}
+
+// vmTenantRegex matches the tenants of VictoriaMetrics clusters, e.g. 1 or 1:2
+var vmTenantRegex = regexp.MustCompile(`^\d+(:\d+)?$`)
+
+// ImportURL returns the URL of the import API, the one of the tenant on the
+// vminsert component if Tenant is set.
+func (v *VMImportTarget) ImportURL() (string, error) {
+	endpoint := strings.TrimSuffix(v.Endpoint, "/")
+	if v.Tenant == "" {
+		return endpoint + "/api/v1/import", nil
+	}
+	if !vmTenantRegex.MatchString(v.Tenant) {
+		return "", errors.Errorf("invalid VictoriaMetrics tenant %s, it must be <accountID>[:<projectID>], e.g. 1 or 1:2", v.Tenant)
+	}
+	if strings.Contains(endpoint, "/insert/") {
+		return "", errors.Errorf("the endpoint %s already has a tenant, it must be the vminsert URL without the /insert/ path", v.Endpoint)
+	}
+	return endpoint + "/insert/" + v.Tenant + "/prometheus/api/v1/import", nil
+}
+
+func (v *VMImportTarget) Name() string {
+	return "VictoriaMetrics import API"
+}
+
+func (v *VMImportTarget) SupportsHistograms() bool {
+	return false
+}
+
+func (v *VMImportTarget) Write(ctx context.Context, batch []*Series) error {
+	var buf bytes.Buffer
+	for _, s := range batch {
+		if len(s.Timestamps) == 0 {
+			continue
+		}
+		l, err := marshalItem(s)
+		if err != nil {
+			return err
+		}
+		buf.Write(l)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	u, err := v.ImportURL()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, &buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/jsonl")
+	return doPushRequest(req, "")
+}
+
+// marshalItem encodes the float samples of the series as a line of the import API.
+func marshalItem(s *Series) ([]byte, error) {
+	item := Item{
+		Metric:     s.Metric,
+		Values:     make([]SampleValue, len(s.Values)),
+		Timestamps: s.Timestamps,
+	}
+	for i, val := range s.Values {
+		item.Values[i] = SampleValue(val)
+	}
+	l, err := json.Marshal(item)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal item")
+	}
+	return append(l, '\n'), nil
+}
+
+// RemoteWriteTarget writes series with the Prometheus remote write v1 protocol.
+type RemoteWriteTarget struct {
+	URL string
+	// Tenant is sent as the X-Scope-OrgID header if set, e.g. for Mimir
+	Tenant string
+}
+
+func (r *RemoteWriteTarget) Name() string {
+	return "remote write"
+}
+
+func (r *RemoteWriteTarget) SupportsHistograms() bool {
+	return true
+}
+
+func (r *RemoteWriteTarget) Write(ctx context.Context, batch []*Series) error {
+	var wr prompb.WriteRequest
+	for _, s := range batch {
+		ts := prompb.TimeSeries{}
+		for name, value := range s.Metric {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool {
+			return ts.Labels[i].Name < ts.Labels[j].Name
+		})
+		for i, t := range s.Timestamps {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: s.Values[i]})
+		}
+		for _, h := range s.Histograms {
+			ts.Histograms = append(ts.Histograms, prompb.FromFloatHistogram(h.Timestamp, h.Histogram))
+		}
+		wr.Timeseries = append(wr.Timeseries, ts)
+	}
+	data, err := wr.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal write request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.URL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return doPushRequest(req, r.Tenant)
+}
+
+func doPushRequest(req *http.Request, tenant string) error {
+	if tenant != "" {
+		req.Header.Set("X-Scope-OrgID", tenant)
+	}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to push metrics")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to push metrics: status=%d body=%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package prompush
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+)
+
+const (
+	// tsdbBlockRange is the range of the blocks written, the range of the
+	// blocks cut by Prometheus from its head
+	tsdbBlockRange = int64(2 * time.Hour / time.Millisecond)
+	// tsdbSamplesPerChunk is the number of samples per chunk of Prometheus
+	tsdbSamplesPerChunk = 120
+	// DefaultTSDBMaxSamples is the default number of samples buffered by TSDBTarget
+	DefaultTSDBMaxSamples = 5_000_000
+)
+
+// TSDBTarget writes series to Prometheus TSDB blocks in a directory. Written
+// samples are buffered in memory by 2h block range, like the blocks of
+// Prometheus, so that a dump yields a block per 2h instead of a block per
+// batch. Sync writes all buffered blocks. As dumps are ordered by query, not
+// by time, a block range is only complete at the end of a file, so when more
+// than MaxSamples samples are buffered, the oldest block ranges are written
+// before that. Their later samples go to another block of the same range,
+// which Prometheus merges when compacting overlapping blocks.
+type TSDBTarget struct {
+	Dir string
+	// MaxSamples is the number of buffered samples above which blocks are
+	// written before Sync, DefaultTSDBMaxSamples if 0
+	MaxSamples int
+
+	mu sync.Mutex
+	// blocks are the buffered series by the min time of their block range
+	blocks  map[int64]*tsdbBlock
+	samples int
+}
+
+// tsdbBlock is the buffered series of a block range.
+type tsdbBlock struct {
+	series  map[string]*tsdbSeries
+	samples int
+}
+
+type tsdbSeries struct {
+	lset    labels.Labels
+	samples []tsdbSample
+}
+
+// tsdbSample is a float sample, or a histogram sample if fh is set.
+type tsdbSample struct {
+	t  int64
+	v  float64
+	fh *histogram.FloatHistogram
+}
+
+func (t *TSDBTarget) Name() string {
+	return "TSDB block writer"
+}
+
+func (t *TSDBTarget) SupportsHistograms() bool {
+	return true
+}
+
+func (t *TSDBTarget) Write(ctx context.Context, batch []*Series) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.blocks == nil {
+		t.blocks = make(map[int64]*tsdbBlock)
+	}
+	for _, s := range batch {
+		var (
+			lset labels.Labels
+			key  string
+		)
+		add := func(sample tsdbSample) {
+			if key == "" {
+				lset = labels.FromMap(s.Metric)
+				key = lset.String()
+			}
+			mint := sample.t - mod(sample.t, tsdbBlockRange)
+			b, ok := t.blocks[mint]
+			if !ok {
+				b = &tsdbBlock{series: make(map[string]*tsdbSeries)}
+				t.blocks[mint] = b
+			}
+			ts, ok := b.series[key]
+			if !ok {
+				ts = &tsdbSeries{lset: lset}
+				b.series[key] = ts
+			}
+			ts.samples = append(ts.samples, sample)
+			b.samples++
+			t.samples++
+		}
+		for i, timestamp := range s.Timestamps {
+			add(tsdbSample{t: timestamp, v: s.Values[i]})
+		}
+		for _, h := range s.Histograms {
+			add(tsdbSample{t: h.Timestamp, fh: h.Histogram})
+		}
+	}
+
+	maxSamples := t.MaxSamples
+	if maxSamples <= 0 {
+		maxSamples = DefaultTSDBMaxSamples
+	}
+	if t.samples <= maxSamples {
+		return nil
+	}
+	// write the oldest block ranges until half of the budget is left, the
+	// newest ones are the most likely to get more samples
+	for _, mint := range t.mints() {
+		if t.samples <= maxSamples/2 {
+			break
+		}
+		if err := t.writeBlock(ctx, mint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync writes all buffered block ranges.
+func (t *TSDBTarget) Sync(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, mint := range t.mints() {
+		if err := t.writeBlock(ctx, mint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mints returns the min times of the buffered block ranges in order.
+func (t *TSDBTarget) mints() []int64 {
+	mints := make([]int64, 0, len(t.blocks))
+	for mint := range t.blocks {
+		mints = append(mints, mint)
+	}
+	sort.Slice(mints, func(i, j int) bool { return mints[i] < mints[j] })
+	return mints
+}
+
+// writeBlock writes the buffered series of the block range as a block, and
+// drops them from the buffer.
+func (t *TSDBTarget) writeBlock(ctx context.Context, mint int64) error {
+	b := t.blocks[mint]
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create TSDB directory")
+	}
+	series := make([]*tsdbSeries, 0, len(b.series))
+	for _, s := range b.series {
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].t < s.samples[j].t })
+		// the first of the samples with the same timestamp wins
+		deduped := s.samples[:1]
+		for _, sample := range s.samples[1:] {
+			if sample.t != deduped[len(deduped)-1].t {
+				deduped = append(deduped, sample)
+			}
+		}
+		s.samples = deduped
+		series = append(series, s)
+	}
+	if err := writeBlock(ctx, t.Dir, mint, mint+tsdbBlockRange, series); err != nil {
+		return err
+	}
+	t.samples -= b.samples
+	delete(t.blocks, mint)
+	return nil
+}
+
+// mod is the modulo of a by b that is never negative.
+func mod(a, b int64) int64 {
+	return (a%b + b) % b
+}
+
+// blockMeta is the meta.json of a block, see tsdb.BlockMeta.
+type blockMeta struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+	Stats   struct {
+		NumSamples          uint64 `json:"numSamples,omitempty"`
+		NumFloatSamples     uint64 `json:"numFloatSamples,omitempty"`
+		NumHistogramSamples uint64 `json:"numHistogramSamples,omitempty"`
+		NumSeries           uint64 `json:"numSeries,omitempty"`
+		NumChunks           uint64 `json:"numChunks,omitempty"`
+	} `json:"stats,omitempty"`
+	Compaction struct {
+		Level   int         `json:"level"`
+		Sources []ulid.ULID `json:"sources,omitempty"`
+	} `json:"compaction"`
+	Version int `json:"version"`
+}
+
+// writeBlock writes the series as a block covering [mint, maxt) to dir. The
+// block is written to a temporary directory first, like Prometheus does, so
+// that an interrupted write never leaves a partial block behind.
+func writeBlock(ctx context.Context, dir string, mint, maxt int64, series []*tsdbSeries) error {
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].lset, series[j].lset) < 0 })
+
+	meta := blockMeta{ULID: ulid.MustNew(ulid.Now(), rand.Reader), MinTime: mint, MaxTime: maxt, Version: 1}
+	meta.Compaction.Level = 1
+	meta.Compaction.Sources = []ulid.ULID{meta.ULID}
+	tmp := filepath.Join(dir, meta.ULID.String()+".tmp-for-creation")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return errors.Wrap(err, "failed to create block directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	cw, err := chunks.NewWriter(filepath.Join(tmp, "chunks"))
+	if err != nil {
+		return errors.Wrap(err, "failed to create chunk writer")
+	}
+	defer cw.Close()
+	iw, err := index.NewWriter(ctx, filepath.Join(tmp, "index"))
+	if err != nil {
+		return errors.Wrap(err, "failed to create index writer")
+	}
+	defer iw.Close()
+
+	symbols := make(map[string]struct{})
+	for _, s := range series {
+		s.lset.Range(func(l labels.Label) {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		})
+	}
+	sorted := make([]string, 0, len(symbols))
+	for sym := range symbols {
+		sorted = append(sorted, sym)
+	}
+	sort.Strings(sorted)
+	for _, sym := range sorted {
+		if err := iw.AddSymbol(sym); err != nil {
+			return errors.Wrap(err, "failed to add symbol")
+		}
+	}
+
+	for i, s := range series {
+		metas, err := encodeChunks(s.samples)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode chunks of %s", s.lset)
+		}
+		if err := cw.WriteChunks(metas...); err != nil {
+			return errors.Wrap(err, "failed to write chunks")
+		}
+		if err := iw.AddSeries(storage.SeriesRef(i), s.lset, metas...); err != nil {
+			return errors.Wrapf(err, "failed to add series %s", s.lset)
+		}
+		meta.Stats.NumSeries++
+		meta.Stats.NumChunks += uint64(len(metas))
+		for _, sample := range s.samples {
+			if sample.fh != nil {
+				meta.Stats.NumHistogramSamples++
+			} else {
+				meta.Stats.NumFloatSamples++
+			}
+		}
+	}
+	meta.Stats.NumSamples = meta.Stats.NumFloatSamples + meta.Stats.NumHistogramSamples
+
+	if err := cw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close chunk writer")
+	}
+	if err := iw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close index writer")
+	}
+	if _, err := tombstones.WriteFile(slog.New(slog.DiscardHandler), tmp, tombstones.NewMemTombstones()); err != nil {
+		return errors.Wrap(err, "failed to write tombstones")
+	}
+	raw, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal block meta")
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "meta.json"), raw, 0644); err != nil {
+		return errors.Wrap(err, "failed to write block meta")
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, meta.ULID.String())); err != nil {
+		return errors.Wrap(err, "failed to rename block directory")
+	}
+	return nil
+}
+
+// encodeChunks encodes the samples sorted by time into chunks of at most
+// tsdbSamplesPerChunk samples, float and histogram samples are never in the
+// same chunk.
+func encodeChunks(samples []tsdbSample) ([]chunks.Meta, error) {
+	var (
+		metas []chunks.Meta
+		chk   chunkenc.Chunk
+		app   chunkenc.Appender
+		err   error
+	)
+	newChunk := func(c chunkenc.Chunk, t int64) error {
+		chk = c
+		metas = append(metas, chunks.Meta{Chunk: c, MinTime: t})
+		app, err = c.Appender()
+		return err
+	}
+	for _, s := range samples {
+		encoding := chunkenc.EncXOR
+		if s.fh != nil {
+			encoding = chunkenc.EncFloatHistogram
+		}
+		if chk == nil || chk.Encoding() != encoding || chk.NumSamples() >= tsdbSamplesPerChunk {
+			var c chunkenc.Chunk = chunkenc.NewXORChunk()
+			if s.fh != nil {
+				c = chunkenc.NewFloatHistogramChunk()
+			}
+			if err := newChunk(c, s.t); err != nil {
+				return nil, err
+			}
+		}
+
+		if s.fh == nil {
+			app.Append(s.t, s.v)
+		} else {
+			c, recoded, next, err := app.AppendFloatHistogram(nil, s.t, s.fh, false)
+			if err != nil {
+				return nil, err
+			}
+			app = next
+			if c != nil {
+				if recoded {
+					// the current chunk was recoded to accommodate the sample
+					metas[len(metas)-1].Chunk = c
+				} else {
+					metas = append(metas, chunks.Meta{Chunk: c, MinTime: s.t})
+				}
+				chk = c
+			}
+		}
+		metas[len(metas)-1].MaxTime = s.t
+	}
+	return metas, nil
+}
@@ -0,0 +1,151 @@
+package prompush
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/stretchr/testify/require"
+)
+
+// readBlock returns the sample timestamps of every series of the block.
+func readBlock(t *testing.T, dir string) map[string][]int64 {
+	ir, err := index.NewFileReader(filepath.Join(dir, "index"), index.DecodePostingsRaw)
+	require.NoError(t, err)
+	defer ir.Close()
+	cr, err := chunks.NewDirReader(filepath.Join(dir, "chunks"), nil)
+	require.NoError(t, err)
+	defer cr.Close()
+
+	ret := make(map[string][]int64)
+	name, value := index.AllPostingsKey()
+	postings, err := ir.Postings(context.Background(), name, value)
+	require.NoError(t, err)
+	for postings.Next() {
+		var (
+			builder labels.ScratchBuilder
+			metas   []chunks.Meta
+		)
+		require.NoError(t, ir.Series(postings.At(), &builder, &metas))
+		name := builder.Labels().String()
+		for _, meta := range metas {
+			chk, _, err := cr.ChunkOrIterable(meta)
+			require.NoError(t, err)
+			it := chk.Iterator(nil)
+			for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+				ret[name] = append(ret[name], it.AtT())
+			}
+		}
+	}
+	require.NoError(t, postings.Err())
+	return ret
+}
+
+func TestTSDBTarget(t *testing.T) {
+	dir := t.TempDir()
+	hour := int64(time.Hour / time.Millisecond)
+	target := &TSDBTarget{Dir: dir}
+	ctx := context.Background()
+
+	// the samples of a series across batches and across the 2h boundary
+	require.NoError(t, target.Write(ctx, []*Series{
+		{Metric: map[string]string{"__name__": "up"}, Timestamps: []int64{hour, 3 * hour}, Values: []float64{1, 1}},
+	}))
+	require.NoError(t, target.Write(ctx, []*Series{
+		{Metric: map[string]string{"__name__": "up"}, Timestamps: []int64{hour + 1, hour}, Values: []float64{1, 2}},
+		{Metric: map[string]string{"__name__": "h"}, Histograms: []HistogramSample{{Timestamp: hour, Histogram: &histogram.FloatHistogram{Count: 1, Sum: 1}}}},
+	}))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "series are only written by Sync")
+
+	require.NoError(t, target.Sync(ctx))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	blocks := make(map[int64]map[string][]int64)
+	for _, e := range entries {
+		raw, err := os.ReadFile(filepath.Join(dir, e.Name(), "meta.json"))
+		require.NoError(t, err)
+		var meta blockMeta
+		require.NoError(t, json.Unmarshal(raw, &meta))
+		require.Equal(t, e.Name(), meta.ULID.String())
+		require.Equal(t, 2*hour, meta.MaxTime-meta.MinTime)
+		blocks[meta.MinTime] = readBlock(t, filepath.Join(dir, e.Name()))
+	}
+	require.Equal(t, map[int64]map[string][]int64{
+		0: {
+			`{__name__="up"}`: {hour, hour + 1},
+			`{__name__="h"}`:  {hour},
+		},
+		2 * hour: {
+			`{__name__="up"}`: {3 * hour},
+		},
+	}, blocks)
+
+	// nothing is left to write
+	require.NoError(t, target.Sync(ctx))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestTSDBTargetMaxSamples(t *testing.T) {
+	dir := t.TempDir()
+	hour := int64(time.Hour / time.Millisecond)
+	target := &TSDBTarget{Dir: dir, MaxSamples: 2}
+	ctx := context.Background()
+
+	mints := func() []int64 {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var ret []int64
+		for _, e := range entries {
+			raw, err := os.ReadFile(filepath.Join(dir, e.Name(), "meta.json"))
+			require.NoError(t, err)
+			var meta blockMeta
+			require.NoError(t, json.Unmarshal(raw, &meta))
+			ret = append(ret, meta.MinTime)
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		return ret
+	}
+
+	// above the budget, the oldest block ranges are written until half of it is left
+	require.NoError(t, target.Write(ctx, []*Series{
+		{Metric: map[string]string{"__name__": "up"}, Timestamps: []int64{hour, 3 * hour, 5 * hour}, Values: []float64{1, 1, 1}},
+	}))
+	require.Equal(t, []int64{0, 2 * hour}, mints())
+
+	// a later sample of a written range goes to another block of the same range
+	require.NoError(t, target.Write(ctx, []*Series{
+		{Metric: map[string]string{"__name__": "down"}, Timestamps: []int64{hour}, Values: []float64{1}},
+	}))
+	require.Equal(t, []int64{0, 2 * hour}, mints())
+	require.NoError(t, target.Sync(ctx))
+	require.Equal(t, []int64{0, 0, 2 * hour, 4 * hour}, mints())
+}
+
+func TestSyncerAck(t *testing.T) {
+	cp := NewCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	pw := NewPushWorker(context.Background(), &PushWorkerCfg{Target: &TSDBTarget{Dir: t.TempDir()}, BatchSize: 1, OnFlush: cp.Ack})
+	defer pw.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		pw.Push(&Series{Metric: map[string]string{"__name__": "up"}, Timestamps: []int64{i}, Values: []float64{1}}, Position{File: "f", Line: i})
+	}
+	// batches flushed to the target are not persisted yet
+	require.Equal(t, FileCheckpoint{}, cp.Get("f"))
+	require.NoError(t, pw.Sync(context.Background()))
+	require.Equal(t, FileCheckpoint{Line: 3}, cp.Get("f"))
+}
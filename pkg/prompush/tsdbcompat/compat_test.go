@@ -0,0 +1,74 @@
+// Package tsdbcompat checks that the blocks written by prompush.TSDBTarget
+// are read by the tsdb package of Prometheus. It is a separate module so that
+// promdump does not depend on the tsdb package and the cloud SDKs it imports.
+package tsdbcompat
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/risingwavelabs/promdump/pkg/prompush"
+	"github.com/stretchr/testify/require"
+)
+
+type sample struct {
+	t int64
+	f float64
+	h *histogram.FloatHistogram
+}
+
+func TestOpenBlocks(t *testing.T) {
+	dir := t.TempDir()
+	hour := int64(time.Hour / time.Millisecond)
+	ctx := context.Background()
+
+	// a small budget so that a block range gets more than one block
+	target := &prompush.TSDBTarget{Dir: dir, MaxSamples: 1}
+	require.NoError(t, target.Write(ctx, []*prompush.Series{
+		{Metric: map[string]string{"__name__": "up", "job": "a"}, Timestamps: []int64{hour, 3 * hour}, Values: []float64{1, 2}},
+	}))
+	require.NoError(t, target.Write(ctx, []*prompush.Series{
+		{Metric: map[string]string{"__name__": "up", "job": "a"}, Timestamps: []int64{hour + 1}, Values: []float64{3}},
+		{Metric: map[string]string{"__name__": "h"}, Histograms: []prompush.HistogramSample{{Timestamp: hour, Histogram: &histogram.FloatHistogram{Count: 1, Sum: 1}}}},
+	}))
+	require.NoError(t, target.Sync(ctx))
+
+	// open the directory like Prometheus does with the blocks in its data dir
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions(), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	db.DisableCompactions()
+	require.Greater(t, len(db.Blocks()), 2, "the budget should split a block range")
+
+	q, err := db.Querier(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	defer q.Close()
+	ss := q.Select(ctx, true, nil, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	got := make(map[string][]sample)
+	for ss.Next() {
+		s := ss.At()
+		it := s.Iterator(nil)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			var smpl sample
+			switch vt {
+			case chunkenc.ValFloat:
+				smpl.t, smpl.f = it.At()
+			case chunkenc.ValFloatHistogram, chunkenc.ValHistogram:
+				smpl.t, smpl.h = it.AtFloatHistogram(nil)
+			}
+			got[s.Labels().String()] = append(got[s.Labels().String()], smpl)
+		}
+	}
+	require.NoError(t, ss.Err())
+	require.Len(t, got, 2)
+	require.Equal(t, []sample{{t: hour, f: 1}, {t: hour + 1, f: 3}, {t: 3 * hour, f: 2}}, got[`{__name__="up", job="a"}`])
+	require.Len(t, got[`{__name__="h"}`], 1)
+	require.Equal(t, hour, got[`{__name__="h"}`][0].t)
+	require.Equal(t, 1.0, got[`{__name__="h"}`][0].h.Count)
+}
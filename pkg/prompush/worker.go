@@ -1,33 +1,45 @@
 package prompush
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// FlushCallback is called after a successful flush with the position of the
+// last item in the flushed batch.
+type FlushCallback func(pos Position) error
+
+type PushWorkerCfg struct {
+	Target    Target
+	BatchSize int
+	OnFlush   FlushCallback
+}
+
+type entry struct {
+	series *Series
+	pos    Position
+	// sync is set for barrier entries, see Sync
+	sync chan error
+}
+
 type PushWorker struct {
-	vmEndpoint string
-	c          chan []byte
-	buf        bytes.Buffer
-	cnt        int
-	mu         sync.Mutex
-	noop       bool
+	target  Target
+	c       chan entry
+	buf     []*Series
+	last    Position
+	mu      sync.Mutex
+	onFlush FlushCallback
 }
 
-func NewPushWorker(ctx context.Context, vmEndpoint string, batchSize int, noop bool) *PushWorker {
+func NewPushWorker(ctx context.Context, cfg *PushWorkerCfg) *PushWorker {
 	w := &PushWorker{
-		vmEndpoint: vmEndpoint,
-		c:          make(chan []byte, batchSize),
-		cnt:        0,
-		noop:       noop,
+		target:  cfg.Target,
+		c:       make(chan entry, cfg.BatchSize),
+		onFlush: cfg.OnFlush,
 	}
 
 	go func() {
@@ -35,13 +47,20 @@ func NewPushWorker(ctx context.Context, vmEndpoint string, batchSize int, noop b
 			select {
 			case <-ctx.Done():
 				return
-			case line := <-w.c:
-				if w.cnt == batchSize {
+			case e, ok := <-w.c:
+				if !ok {
+					return
+				}
+				if e.sync != nil {
+					e.sync <- w.flushAndSync(ctx)
+					continue
+				}
+				if len(w.buf) >= cfg.BatchSize {
 					if err := w.Flush(ctx); err != nil {
 						log.Printf("failed to flush: %s", err)
 					}
 				}
-				w.Append(line)
+				w.Append(e.series, e.pos)
 			}
 		}
 	}()
@@ -49,74 +68,97 @@ func NewPushWorker(ctx context.Context, vmEndpoint string, batchSize int, noop b
 	return w
 }
 
-func (w *PushWorker) Append(line []byte) {
-	w.buf.Write(line)
-	w.cnt++
+func (w *PushWorker) Append(series *Series, pos Position) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, series)
+	w.last = pos
 }
 
-func (w *PushWorker) Push(line []byte) {
-	w.c <- line
+func (w *PushWorker) Push(series *Series, pos Position) {
+	w.c <- entry{series: series, pos: pos}
 }
 
-func (w *PushWorker) Flush(ctx context.Context) error {
-	if w.noop {
-		return w.FlushNoops(ctx)
+// SupportsHistograms reports whether the target accepts native histogram samples.
+func (w *PushWorker) SupportsHistograms() bool {
+	return w.target.SupportsHistograms()
+}
+
+// TargetName returns the name of the target.
+func (w *PushWorker) TargetName() string {
+	return w.target.Name()
+}
+
+// Sync waits until every item pushed so far has been appended, then flushes
+// the buffer and syncs the target, see Syncer.
+func (w *PushWorker) Sync(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case w.c <- entry{sync: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return w.FlushToEndpoint(ctx)
 }
 
-func (w *PushWorker) FlushNoops(ctx context.Context) error {
+func (w *PushWorker) Flush(ctx context.Context) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.buf.Len() == 0 {
+	if len(w.buf) == 0 {
 		return nil
 	}
 
+	// keep mutex locked during transmission
+	if err := w.target.Write(ctx, w.buf); err != nil {
+		return errors.Wrapf(err, "failed to write to %s", w.target.Name())
+	}
+
 	// reset the buffer
-	w.buf.Reset()
-	w.cnt = 0
-	return nil
+	w.buf = nil
+	if _, ok := w.target.(Syncer); ok {
+		// the series are only persisted by the next sync
+		return nil
+	}
+	return w.ack()
 }
 
-func (w *PushWorker) FlushToEndpoint(ctx context.Context) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.buf.Len() == 0 {
+// flushAndSync flushes the buffer, and syncs the target if it buffers the
+// written series.
+func (w *PushWorker) flushAndSync(ctx context.Context) error {
+	if err := w.Flush(ctx); err != nil {
+		return err
+	}
+	syncer, ok := w.target.(Syncer)
+	if !ok {
 		return nil
 	}
-
-	// Create a copy of the buffer data to avoid modification during HTTP transfer
-	data := make([]byte, w.buf.Len())
-	copy(data, w.buf.Bytes())
-
-	// Use http.Client directly instead of http.Post to keep mutex locked during transmission
-	req, err := http.NewRequestWithContext(ctx, "POST", w.vmEndpoint+"/api/v1/import", bytes.NewReader(data))
-	if err != nil {
-		return errors.Wrap(err, "failed to create request")
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := syncer.Sync(ctx); err != nil {
+		return errors.Wrapf(err, "failed to sync %s", w.target.Name())
 	}
-	req.Header.Set("Content-Type", "application/jsonl")
+	return w.ack()
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "failed to push metrics")
+// ack reports the last flushed position, the caller must hold w.mu.
+func (w *PushWorker) ack() error {
+	if w.onFlush == nil || w.last.File == "" {
+		return nil
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to push metrics: status=%d body=%s", resp.StatusCode, string(body))
+	if err := w.onFlush(w.last); err != nil {
+		return errors.Wrap(err, "failed to run flush callback")
 	}
-
-	// reset the buffer
-	w.buf.Reset()
-	w.cnt = 0
 	return nil
 }
 
 func (w *PushWorker) Close() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_ = w.Flush(ctx)
+	_ = w.Sync(ctx)
 	close(w.c)
 }
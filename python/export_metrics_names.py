@@ -5,6 +5,9 @@ import urllib.error
 import json
 import os
 
+# the catalog embedded in the promdump binary
+CATALOG_DIR = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "pkg", "promdump", "catalog")
+
 def _wait_for_http_ready(url: str, timeout: float = 3600.0, interval: float = 0.5) -> None:
     deadline = time.time() + timeout
     last_exc = None
@@ -19,8 +22,25 @@ def _wait_for_http_ready(url: str, timeout: float = 3600.0, interval: float = 0.
     raise TimeoutError(f"Timed out waiting for {url}") from last_exc
 
 
+def export_dashboard(version: str):
+    filename = os.path.join(CATALOG_DIR, "dashboards", f"{version}.json")
+    if os.path.exists(filename):
+        print(f"Dashboard for version {version} already exported. Skipping.")
+        return
+
+    url = f"https://raw.githubusercontent.com/risingwavelabs/risingwave/refs/tags/{version}/grafana/risingwave-dev-dashboard.json"
+    try:
+        with urllib.request.urlopen(url) as resp:
+            content = resp.read()
+    except urllib.error.HTTPError as e:
+        print(f"Failed to export dashboard for version {version}: {e}")
+        return
+    with open(filename, "wb") as f:
+        f.write(content)
+
+
 def export(version: str):
-    filename = f"metrics/{version}.txt"
+    filename = os.path.join(CATALOG_DIR, "metrics", f"{version}.txt")
     if os.path.exists(filename):
         print(f"Metrics for version {version} already exported. Skipping.")
         return
@@ -85,6 +105,7 @@ def main():
         for tag in tags:
             version = tag["name"]
             print(f"Exporting metrics for version: {version}")
+            export_dashboard(version)
             export(version)
 
 if __name__ == "__main__":